@@ -0,0 +1,40 @@
+package munproto
+
+import (
+	"net"
+	"time"
+)
+
+// Acceptor is a source of conns which isn't a net.Listener, e.g. the streams of a yamux or smux session.
+type Acceptor interface {
+	Accept() (net.Conn, error)
+	Close() error
+}
+
+// create dispatcher on top of a, e.g. to detect the proto of each stream of a multiplexed session. If a has no
+// Addr method, the listeners report a placeholder address. Like with New, Listen returns when Accept fails with a
+// non temporary error, e.g. when the session is closed.
+func NewFromAcceptor(a Acceptor, timeout time.Duration, opts ...Option) *Dispatcher {
+	if l, ok := a.(net.Listener); ok {
+		return New(l, timeout, opts...)
+	}
+	return New(acceptorListener{a}, timeout, opts...)
+}
+
+type acceptorListener struct {
+	Acceptor
+}
+
+func (self acceptorListener) Addr() net.Addr {
+	if a, ok := self.Acceptor.(interface{ Addr() net.Addr }); ok {
+		if addr := a.Addr(); addr != nil {
+			return addr
+		}
+	}
+	return acceptorAddr{}
+}
+
+type acceptorAddr struct{}
+
+func (acceptorAddr) Network() string { return "acceptor" }
+func (acceptorAddr) String() string  { return "acceptor" }
@@ -0,0 +1,92 @@
+package munproto_test
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+)
+
+// memMux is a minimal multiplexed session, its streams are pipes. It has no Addr method.
+type memMux struct {
+	streams   chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemMux() *memMux {
+	return &memMux{streams: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// open a stream, returns the client end
+func (self *memMux) open() net.Conn {
+	client, server := net.Pipe()
+	select {
+	case self.streams <- server:
+	case <-self.done:
+		server.Close()
+	}
+	return client
+}
+
+func (self *memMux) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.streams:
+		return conn, nil
+	case <-self.done:
+		return nil, io.EOF
+	}
+}
+
+func (self *memMux) Close() error {
+	self.closeOnce.Do(func() { close(self.done) })
+	return nil
+}
+
+func TestNewFromAcceptor(t *testing.T) {
+	mux := newMemMux()
+	d := munproto.NewFromAcceptor(mux, time.Second)
+	d.AddProto("socks5", munproto.IsSOCKS5)
+	d.AddProto("http", munproto.IsHTTP)
+	socks5 := d.Listener("socks5")
+	http := d.Listener("http")
+	if addr := http.Addr(); addr.Network() != "acceptor" || addr.String() != "acceptor" {
+		t.Fatalf("Addr() = %s %s, want the placeholder address", addr.Network(), addr)
+	}
+
+	listened := make(chan error, 1)
+	go func() {
+		listened <- d.Listen()
+	}()
+
+	for _, tt := range []struct {
+		data string
+		l    net.Listener
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", http},
+		{"\x05\x01\x00", socks5},
+	} {
+		stream := mux.open()
+		defer stream.Close()
+		go stream.Write([]byte(tt.data))
+
+		conn := acceptWithin(t, tt.l, time.Second)
+		data := make([]byte, len(tt.data))
+		if _, err := io.ReadFull(conn, data); err != nil || string(data) != tt.data {
+			t.Fatalf("stream read %q, %v, want %q", data, err, tt.data)
+		}
+		conn.Close()
+	}
+
+	// closing the session ends Listen like closing a listener
+	mux.Close()
+	select {
+	case <-listened:
+	case <-time.After(time.Second):
+		t.Fatal("Listen didn't return after the session was closed")
+	}
+	d.Close()
+}
@@ -0,0 +1,136 @@
+package munproto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// ErrAccessDenied is the DispatchRecord.Err of conns rejected by the policy of the matched proto.
+var ErrAccessDenied = errors.New("munproto: access denied")
+
+// Policy restricts the clients which can be dispatched to a proto, see Dispatcher.Restrict.
+type Policy struct {
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	fallThrough bool
+	err         error
+}
+
+type PolicyOption func(*Policy)
+
+// allow only clients from the given networks.
+func AllowCIDRs(cidrs ...string) PolicyOption {
+	return func(p *Policy) {
+		p.allow = p.parse(p.allow, cidrs)
+	}
+}
+
+// deny clients from the given networks, deny takes precedence over allow.
+func DenyCIDRs(cidrs ...string) PolicyOption {
+	return func(p *Policy) {
+		p.deny = p.parse(p.deny, cidrs)
+	}
+}
+
+// evaluate the later protos for denied clients instead of closing their conns.
+func FallThrough() PolicyOption {
+	return func(p *Policy) {
+		p.fallThrough = true
+	}
+}
+
+func (self *Policy) parse(nets []*net.IPNet, cidrs []string) []*net.IPNet {
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			if self.err == nil {
+				self.err = err
+			}
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+func (self *Policy) allowed(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return len(self.allow) == 0
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, ipnet := range self.deny {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(self.allow) == 0 {
+		return true
+	}
+	for _, ipnet := range self.allow {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// restrict the clients which can be dispatched to proto. When the detector of proto matches a conn from a client the
+// policy doesn't allow, the conn is closed, or evaluated against the later protos with FallThrough. Either way the
+// client is counted in Stats.Denied and reported to OnDenied. Invalid networks are reported by the returned error and
+// the policy isn't applied.
+func (self *Dispatcher) Restrict(proto string, opts ...PolicyOption) error {
+	policy := &Policy{}
+	for _, opt := range opts {
+		opt(policy)
+	}
+	if policy.err != nil {
+		return policy.err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	p, ok := self.protos[proto]
+	if !ok {
+		return fmt.Errorf("munproto: undefined proto: %s", proto)
+	}
+
+	// running dispatches may use the proto, so it is replaced instead of modified
+	restricted := *p
+	restricted.policy = policy
+	self.protos[proto] = &restricted
+	self.rebuildSet()
+	return nil
+}
+
+// count a client denied by the policy of proto
+func (self *Dispatcher) denied(proto string, addr net.Addr) {
+	atomic.AddInt64(&self.counters.Denied, 1)
+	if self.OnDenied != nil {
+		self.OnDenied(proto, addr)
+	}
+}
@@ -0,0 +1,148 @@
+package munproto_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+type deniedClient struct {
+	proto string
+	addr  string
+}
+
+// create a dispatcher which takes the client address from the PROXY protocol header, so the tests control it
+func aclDispatcher(t *testing.T) (*munproto.Dispatcher, *munprototest.PipeListener, chan deniedClient) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.ProxyProtocol = true
+	denied := make(chan deniedClient, 4)
+	d.OnDenied = func(proto string, addr net.Addr) {
+		denied <- deniedClient{proto, addr.String()}
+	}
+	return d, pl, denied
+}
+
+// send an HTTP request from the client address src
+func sendFrom(t *testing.T, pl *munprototest.PipeListener, src string) {
+	t.Helper()
+	ip := net.ParseIP(src)
+	fam, addrs := byte(0x21), append(append(ip.To16(), net.ParseIP("2001:db8::1").To16()...), 0x30, 0x39, 0x00, 0x50)
+	// IPv4-mapped addresses are sent in the IPv6 family, as a dual-stack proxy reports them
+	if ip.To4() != nil && src == ip.To4().String() {
+		fam, addrs = 0x11, append(append(ip.To4(), 192, 0, 2, 1), 0x30, 0x39, 0x00, 0x50)
+	}
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go conn.Write(append(proxyHeader(1, fam, addrs), "GET / HTTP/1.1\r\n\r\n"...))
+}
+
+func TestRestrict(t *testing.T) {
+	office := munproto.AllowCIDRs("203.0.113.0/24", "2001:db8::/32")
+	tests := []struct {
+		name    string
+		policy  []munproto.PolicyOption
+		src     string
+		allowed bool
+	}{
+		{"ipv4 allowed", []munproto.PolicyOption{office}, "203.0.113.5", true},
+		{"ipv4 denied", []munproto.PolicyOption{office}, "198.51.100.7", false},
+		{"ipv6 allowed", []munproto.PolicyOption{office}, "2001:db8:1::5", true},
+		{"ipv6 denied", []munproto.PolicyOption{office}, "2001:db9::5", false},
+		// IPv4-mapped IPv6 peers of dual-stack sockets match the IPv4 networks
+		{"mapped allowed", []munproto.PolicyOption{office}, "::ffff:203.0.113.5", true},
+		{"mapped denied", []munproto.PolicyOption{office}, "::ffff:198.51.100.7", false},
+		{"mapped deny", []munproto.PolicyOption{munproto.DenyCIDRs("203.0.113.0/24")}, "::ffff:203.0.113.5", false},
+		{"deny precedence", []munproto.PolicyOption{office, munproto.DenyCIDRs("203.0.113.5/32")}, "203.0.113.5", false},
+		{"deny only", []munproto.PolicyOption{munproto.DenyCIDRs("203.0.113.5/32")}, "203.0.113.6", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, pl, denied := aclDispatcher(t)
+			http := d.Listener("http")
+			if err := d.Restrict("http", tt.policy...); err != nil {
+				t.Fatal(err)
+			}
+			recs := accessLog(d)
+			go d.Listen()
+			defer d.Close()
+
+			sendFrom(t, pl, tt.src)
+			if tt.allowed {
+				acceptWithin(t, http, time.Second).Close()
+			}
+			rec := onlyRecord(t, recs)
+			if got := rec.Err == nil; got != tt.allowed {
+				t.Fatalf("DispatchRecord.Err = %v, want allowed %v", rec.Err, tt.allowed)
+			}
+			if !tt.allowed && (!errors.Is(rec.Err, munproto.ErrAccessDenied) || !rec.Rejected) {
+				t.Fatalf("DispatchRecord = %+v, want a denied conn", rec)
+			}
+
+			var want int64
+			if !tt.allowed {
+				want = 1
+				c := <-denied
+				if host, _, _ := net.SplitHostPort(c.addr); c.proto != "http" || !net.ParseIP(host).Equal(net.ParseIP(tt.src)) {
+					t.Fatalf("OnDenied(%q, %s), want http and %s", c.proto, c.addr, tt.src)
+				}
+			}
+			if n := d.Stats().Denied; n != want || len(denied) != 0 {
+				t.Fatalf("Denied = %d, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestRestrictFallThrough(t *testing.T) {
+	d, pl, denied := aclDispatcher(t)
+	d.Listener("http")
+	if err := d.Restrict("http", munproto.AllowCIDRs("203.0.113.0/24"), munproto.FallThrough()); err != nil {
+		t.Fatal(err)
+	}
+	// a catch-all after http gets the denied clients
+	d.AddProto("public", func(*bufio.Reader) (bool, error) { return true, nil })
+	public := d.Listener("public")
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+
+	sendFrom(t, pl, "198.51.100.7")
+	acceptWithin(t, public, time.Second).Close()
+	if rec := onlyRecord(t, recs); rec.Err != nil || rec.Proto != "public" {
+		t.Fatalf("DispatchRecord = %+v, want the conn delivered to public", rec)
+	}
+	select {
+	case c := <-denied:
+		if c.proto != "http" || c.addr != "198.51.100.7:12345" {
+			t.Fatalf("OnDenied(%q, %s), want http and the client address", c.proto, c.addr)
+		}
+	default:
+		t.Fatal("OnDenied not called for a conn which fell through")
+	}
+	if n := d.Stats().Denied; n != 1 {
+		t.Fatalf("Denied = %d, want 1", n)
+	}
+}
+
+func TestRestrictInvalid(t *testing.T) {
+	d := munproto.NewDefault(munprototest.NewPipeListener())
+	d.Listener("http")
+	if err := d.Restrict("http", munproto.AllowCIDRs("203.0.113.0/33")); err == nil {
+		t.Fatal("Restrict accepted an invalid network")
+	}
+	if err := d.Restrict("nope", munproto.AllowCIDRs("203.0.113.0/24")); err == nil {
+		t.Fatal("Restrict accepted an undefined proto")
+	}
+}
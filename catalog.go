@@ -0,0 +1,65 @@
+package munproto
+
+import (
+	"bufio"
+	"sort"
+)
+
+// ProtoInfo describes a proto for the catalog of BuiltinProtos and for AddProtoInfo.
+type ProtoInfo struct {
+	Name        string
+	Description string
+	// the number of bytes the detector peeks at least before it can match
+	MinPeekBytes int
+	Detect       func(*bufio.Reader) (bool, error)
+}
+
+var builtinProtos = []ProtoInfo{
+	{"socks5", "SOCKS5 proxy, version byte 5", 1, IsSOCKS5},
+	{"socks4", "SOCKS4 proxy, version byte 4", 1, IsSOCKS4},
+	{"https", "TLS, handshake record", 1, IsHTTPS},
+	{"http", "HTTP/1.x request", 7, IsHTTP},
+	{"openvpn", "OpenVPN in TCP mode, client reset packet", 3, IsOpenVPN},
+	{"sslv2", "ClientHello in the SSLv2 compatible format", 5, IsSSLv2ClientHello},
+	{"tds", "MS SQL Server, TDS prelogin packet", 8, IsTDS},
+	{"cql", "Cassandra CQL native protocol v3 to v5", 9, IsCQL},
+	{"rdp", "RDP, TPKT with X.224 connection request", 7, IsRDP},
+	{"telnet", "telnet starting with option negotiation", 3, IsTelnet},
+	{"git", "git daemon protocol", 8, IsGit},
+	{"rsync", "rsync daemon protocol", len(rsyncGreeting), IsRsync},
+	{"syslog", "syslog over TCP (RFC 6587)", 3, IsSyslog},
+	{"graphite", "graphite plaintext protocol", 6, IsGraphite},
+	{"lumberjack", "Beats Lumberjack v2", 2, IsLumberjack},
+	{"fluent-forward", "fluentd forward protocol", 2, IsFluentForward},
+	{"zmtp", "ZeroMQ ZMTP 3.x greeting", 10, IsZMTP},
+	{"irc", "IRC client registration", 4, IsIRC},
+	{"modbus", "Modbus TCP", 8, IsModbus},
+	{"bgp", "BGP OPEN message", 19, IsBGP},
+	{"smpp", "SMPP bind PDU", 16, IsSMPP},
+	{"clickhouse", "ClickHouse native protocol Hello packet", 2 + len(clickHouseName), IsClickHouse},
+}
+
+// return the catalog of the built-in detectors, sorted by name. The default protos of NewDefault are among them.
+func BuiltinProtos() []ProtoInfo {
+	protos := append([]ProtoInfo{}, builtinProtos...)
+	sort.Slice(protos, func(i, j int) bool {
+		return protos[i].Name < protos[j].Name
+	})
+	return protos
+}
+
+// return the built-in proto with name.
+func builtinProto(name string) (ProtoInfo, bool) {
+	for _, info := range builtinProtos {
+		if info.Name == name {
+			return info, true
+		}
+	}
+	return ProtoInfo{}, false
+}
+
+// register a proto described by info, same as AddProto(info.Name, info.Detect, opts...) but the description is
+// shown by DebugHandler.
+func (self *Dispatcher) AddProtoInfo(info ProtoInfo, opts ...Option) {
+	self.addProto(&proto{name: info.Name, detectfn: info.Detect, info: info}, opts)
+}
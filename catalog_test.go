@@ -0,0 +1,48 @@
+package munproto_test
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+func TestDefaultProtosInCatalog(t *testing.T) {
+	catalog := map[string]string{}
+	for _, info := range munproto.BuiltinProtos() {
+		catalog[info.Name] = info.Description
+	}
+
+	desc := descriptions(munproto.NewDefault(munprototest.NewPipeListener()))
+	for _, name := range munproto.DefaultOrder() {
+		if d, ok := catalog[name]; !ok || desc[name] != d {
+			t.Errorf("default proto %s registered with %q, catalog has %q, %v", name, desc[name], d, ok)
+		}
+	}
+}
+
+func TestDetectProtoCatalog(t *testing.T) {
+	tests := []struct {
+		data   string
+		protos []string
+		want   string
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", nil, "http"},
+		{"\x05\x01\x00", nil, "socks5"},
+		// built-in protos which aren't default ones are detected when named
+		{"\x00\x0e\x38\x4f\x91\x2b\x6a\xd0\x17\xe3\x55\x00\x00\x00\x00\x00", []string{"http", "openvpn"}, "openvpn"},
+	}
+
+	for _, tt := range tests {
+		got, err := munproto.DetectProto(bufio.NewReader(strings.NewReader(tt.data)), tt.protos...)
+		if err != nil || got != tt.want {
+			t.Errorf("DetectProto(%q, %q) = %q, %v, want %q", tt.data, tt.protos, got, err, tt.want)
+		}
+	}
+
+	if _, err := munproto.DetectProto(bufio.NewReader(strings.NewReader("x")), "nope"); err == nil {
+		t.Error("DetectProto with an undefined proto didn't fail")
+	}
+}
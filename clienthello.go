@@ -0,0 +1,292 @@
+package munproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	recordTypeHandshake        = 0x16
+	handshakeTypeClientHello   = 0x01
+	extensionServerName        = 0x0000
+	extensionALPN              = 0x0010
+	extensionSupportedVersions = 0x002b
+)
+
+var errInvalidClientHello = errors.New("munproto: invalid tls client hello")
+
+// WithTLSInfo parses the ClientHello of matched TLS conns and records it, it is then available through
+// TLSClientHelloInfo, the server name (SNI) also through TLSServerName and DispatchRecord.ServerName. It costs more
+// than detection, which checks a single byte.
+func WithTLSInfo() Option {
+	return func(o *options) {
+		o.tlsInfo = true
+	}
+}
+
+// return the server name sent by the client of a TLS conn delivered by the dispatcher with WithTLSInfo, empty if the
+// client didn't send it.
+func TLSServerName(conn net.Conn) string {
+	bufconn := bufConnOf(conn)
+	if bufconn == nil {
+		return ""
+	}
+	return bufconn.serverName
+}
+
+// peek the ClientHello handshake message, including its 4 byte header, without consuming it. The message may be
+// fragmented over several records, then it is reassembled into a new slice.
+func peekClientHello(r *bufio.Reader) ([]byte, error) {
+	var msg []byte
+	need := -1
+	off := 0
+	for {
+		hdr, err := r.Peek(off + 5)
+		if err != nil {
+			return nil, err
+		}
+		if hdr[off] != recordTypeHandshake {
+			return nil, errInvalidClientHello
+		}
+
+		n := int(binary.BigEndian.Uint16(hdr[off+3:]))
+		rec, err := r.Peek(off + 5 + n)
+		if err != nil {
+			return nil, err
+		}
+		fragment := rec[off+5:]
+		off += 5 + n
+
+		if msg == nil && len(fragment) >= 4 {
+			if fragment[0] != handshakeTypeClientHello {
+				return nil, errInvalidClientHello
+			}
+			if need = 4 + uint24(fragment[1:]); len(fragment) >= need {
+				return fragment[:need], nil
+			}
+		}
+
+		msg = append(msg, fragment...)
+		if need < 0 && len(msg) >= 4 {
+			if msg[0] != handshakeTypeClientHello {
+				return nil, errInvalidClientHello
+			}
+			need = 4 + uint24(msg[1:])
+		}
+		if need >= 0 && len(msg) >= need {
+			return msg[:need], nil
+		}
+	}
+}
+
+func uint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// helloReader reads the length prefixed fields of a handshake message.
+type helloReader []byte
+
+func (self *helloReader) bytes(n int) ([]byte, bool) {
+	if n < 0 || len(*self) < n {
+		return nil, false
+	}
+	b := (*self)[:n]
+	*self = (*self)[n:]
+	return b, true
+}
+
+func (self *helloReader) u8() (int, bool) {
+	b, ok := self.bytes(1)
+	if !ok {
+		return 0, false
+	}
+	return int(b[0]), true
+}
+
+func (self *helloReader) u16() (int, bool) {
+	b, ok := self.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(b)), true
+}
+
+func (self *helloReader) vec8() (helloReader, bool) {
+	n, ok := self.u8()
+	if !ok {
+		return nil, false
+	}
+	b, ok := self.bytes(n)
+	return b, ok
+}
+
+func (self *helloReader) vec16() (helloReader, bool) {
+	n, ok := self.u16()
+	if !ok {
+		return nil, false
+	}
+	b, ok := self.bytes(n)
+	return b, ok
+}
+
+// ClientHelloInfo is the parsed ClientHello of a TLS conn. GREASE values (RFC 8701) are removed from all lists.
+type ClientHelloInfo struct {
+	// the legacy version field of the ClientHello
+	Version    uint16
+	ServerName string
+	// ALPN protocols
+	SupportedProtos []string
+	// versions of the supported_versions extension, sent by TLS 1.3 clients
+	SupportedVersions []uint16
+	CipherSuites      []uint16
+	// all extensions in the order of the ClientHello
+	Extensions []TLSExtension
+}
+
+// TLSExtension is an extension of a ClientHello.
+type TLSExtension struct {
+	Type uint16
+	Data []byte
+}
+
+// create a detector which matches TLS conns for which fn returns true, it is called with the parsed ClientHello. The
+// ClientHello is peeked including all its records, so the stream isn't consumed. Conns whose ClientHello doesn't parse
+// don't match.
+func TLSClientHello(fn func(info ClientHelloInfo) bool) func(*bufio.Reader) (bool, error) {
+	return func(r *bufio.Reader) (bool, error) {
+		data, err := r.Peek(1)
+		if err != nil {
+			return false, err
+		}
+		if data[0] != recordTypeHandshake {
+			return false, nil
+		}
+
+		msg, err := peekClientHello(r)
+		if err == errInvalidClientHello {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		info, ok := parseClientHello(msg)
+		return ok && fn(info), nil
+	}
+}
+
+// return the ClientHello of a TLS conn delivered by the dispatcher with WithTLSInfo, ok is false for other conns.
+func TLSClientHelloInfo(conn net.Conn) (info ClientHelloInfo, ok bool) {
+	bufconn := bufConnOf(conn)
+	if bufconn == nil || bufconn.hello == nil {
+		return ClientHelloInfo{}, false
+	}
+	return *bufconn.hello, true
+}
+
+// report whether v is a GREASE value, 0x0a0a, 0x1a1a and so on.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// parse the ClientHello message msg, ok is false if it is malformed. The extension data is copied, so info stays
+// valid after msg is gone.
+func parseClientHello(msg []byte) (info ClientHelloInfo, ok bool) {
+	s := helloReader(msg)
+	if _, ok := s.bytes(4); !ok {
+		return info, false
+	}
+	version, ok := s.u16()
+	if !ok {
+		return info, false
+	}
+	info.Version = uint16(version)
+
+	if _, ok := s.bytes(32); !ok { // random
+		return info, false
+	}
+	if _, ok := s.vec8(); !ok { // session id
+		return info, false
+	}
+
+	suites, ok := s.vec16()
+	if !ok {
+		return info, false
+	}
+	for len(suites) > 0 {
+		suite, ok := suites.u16()
+		if !ok {
+			return info, false
+		}
+		if !isGREASE(uint16(suite)) {
+			info.CipherSuites = append(info.CipherSuites, uint16(suite))
+		}
+	}
+
+	if _, ok := s.vec8(); !ok { // compression methods
+		return info, false
+	}
+	if len(s) == 0 {
+		// no extensions
+		return info, true
+	}
+
+	exts, ok := s.vec16()
+	if !ok {
+		return info, false
+	}
+	for len(exts) > 0 {
+		typ, ok := exts.u16()
+		if !ok {
+			return info, false
+		}
+		data, ok := exts.vec16()
+		if !ok {
+			return info, false
+		}
+		if isGREASE(uint16(typ)) {
+			continue
+		}
+		info.Extensions = append(info.Extensions, TLSExtension{Type: uint16(typ), Data: append([]byte{}, data...)})
+
+		switch typ {
+		case extensionServerName:
+			info.ServerName = parseServerNameExt(data)
+		case extensionALPN:
+			protos, ok := data.vec16()
+			for ok && len(protos) > 0 {
+				var proto helloReader
+				if proto, ok = protos.vec8(); ok {
+					info.SupportedProtos = append(info.SupportedProtos, string(proto))
+				}
+			}
+		case extensionSupportedVersions:
+			versions, ok := data.vec8()
+			for ok && len(versions) > 0 {
+				var v int
+				if v, ok = versions.u16(); ok && !isGREASE(uint16(v)) {
+					info.SupportedVersions = append(info.SupportedVersions, uint16(v))
+				}
+			}
+		}
+	}
+	return info, true
+}
+
+// return the host name of the server_name extension data, empty if there is none.
+func parseServerNameExt(data helloReader) string {
+	names, ok := data.vec16()
+	for ok && len(names) > 0 {
+		var nameType int
+		var name helloReader
+		if nameType, ok = names.u8(); !ok {
+			break
+		}
+		if name, ok = names.vec16(); ok && nameType == 0 {
+			return string(name)
+		}
+	}
+	return ""
+}
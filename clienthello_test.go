@@ -0,0 +1,255 @@
+package munproto_test
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// append the length of data as a big endian integer of size bytes, then data
+func vec(size int, data []byte) []byte {
+	b := make([]byte, size, size+len(data))
+	for i, n := size-1, len(data); i >= 0; i, n = i-1, n>>8 {
+		b[i] = byte(n)
+	}
+	return append(b, data...)
+}
+
+func u16s(vs ...uint16) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func extension(typ uint16, data []byte) []byte {
+	return append(u16s(typ), vec(2, data)...)
+}
+
+func sniExt(name string) []byte {
+	return extension(0x0000, vec(2, append([]byte{0}, vec(2, []byte(name))...)))
+}
+
+func alpnExt(protos ...string) []byte {
+	var list []byte
+	for _, proto := range protos {
+		list = append(list, vec(1, []byte(proto))...)
+	}
+	return extension(0x0010, vec(2, list))
+}
+
+func versionsExt(versions ...uint16) []byte {
+	return extension(0x002b, vec(1, u16s(versions...)))
+}
+
+// create a ClientHello handshake message with the cipher suites and extensions
+func clientHello(suites []uint16, exts ...[]byte) []byte {
+	body := u16s(0x0303)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, vec(1, nil)...)      // session id
+	body = append(body, vec(2, u16s(suites...))...)
+	body = append(body, vec(1, []byte{0})...) // compression methods
+	var list []byte
+	for _, ext := range exts {
+		list = append(list, ext...)
+	}
+	body = append(body, vec(2, list)...)
+	return append([]byte{0x01}, vec(3, body)...)
+}
+
+// split msg into handshake records with fragments of sizes bytes, the rest goes into the last record
+func records(msg []byte, sizes ...int) []byte {
+	var data []byte
+	for _, n := range append(sizes, len(msg)) {
+		if n > len(msg) {
+			n = len(msg)
+		}
+		data = append(data, 0x16, 0x03, 0x01)
+		data = append(data, vec(2, msg[:n])...)
+		msg = msg[n:]
+	}
+	return data
+}
+
+func TestTLSInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"server name", records(clientHello([]uint16{0x1301}, sniExt("example.com"))), "example.com"},
+		{"several records", records(clientHello([]uint16{0x1301}, alpnExt("h2"), sniExt("example.com")), 10, 20), "example.com"},
+		// a missing server name isn't an error
+		{"no server name", records(clientHello([]uint16{0x1301}, alpnExt("h2"))), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := munprototest.NewPipeListener()
+			d := munproto.NewDefault(pl, munproto.WithTLSInfo())
+			https := d.Listener("https")
+			logged := make(chan munproto.DispatchRecord, 1)
+			d.AccessLog = func(rec munproto.DispatchRecord) {
+				logged <- rec
+			}
+			go d.Listen()
+			defer d.Close()
+
+			conn, err := pl.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			data := append(tt.data, "tail"...)
+			go conn.Write(data)
+
+			delivered := acceptWithin(t, https, time.Second)
+			defer delivered.Close()
+			if name := munproto.TLSServerName(delivered); name != tt.want {
+				t.Fatalf("TLSServerName() = %q, want %q", name, tt.want)
+			}
+			if info, ok := munproto.TLSClientHelloInfo(delivered); !ok || info.ServerName != tt.want || len(info.CipherSuites) != 1 {
+				t.Fatalf("TLSClientHelloInfo() = %+v, %v", info, ok)
+			}
+			if rec := <-logged; rec.ServerName != tt.want {
+				t.Fatalf("DispatchRecord.ServerName = %q, want %q", rec.ServerName, tt.want)
+			}
+
+			// parsing the ClientHello doesn't consume it
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(delivered, got); err != nil || string(got) != string(data) {
+				t.Fatalf("delivered conn read %q, %v, want the ClientHello and the tail", got, err)
+			}
+		})
+	}
+}
+
+// return the ClientHelloInfo which TLSClientHello passes for data
+func parseHello(t *testing.T, data []byte) munproto.ClientHelloInfo {
+	t.Helper()
+	var info munproto.ClientHelloInfo
+	ok, err := munprototest.DetectBytes(munproto.TLSClientHello(func(i munproto.ClientHelloInfo) bool {
+		info = i
+		return true
+	}), data)
+	if !ok || err != nil {
+		t.Fatalf("TLSClientHello() = %v, %v, want true, nil", ok, err)
+	}
+	return info
+}
+
+func TestTLSClientHelloGREASE(t *testing.T) {
+	msg := clientHello([]uint16{0x0a0a, 0x1301, 0x1302},
+		extension(0x2a2a, nil),
+		sniExt("a.example"),
+		alpnExt("h2", "http/1.1"),
+		versionsExt(0x1a1a, 0x0304, 0x0303),
+		extension(0x3a3a, []byte{0}),
+	)
+	info := parseHello(t, records(msg))
+
+	if info.Version != 0x0303 || info.ServerName != "a.example" {
+		t.Fatalf("Version, ServerName = %#x, %q", info.Version, info.ServerName)
+	}
+	if want := []uint16{0x1301, 0x1302}; !reflect.DeepEqual(info.CipherSuites, want) {
+		t.Fatalf("CipherSuites = %#x, want %#x", info.CipherSuites, want)
+	}
+	if want := []uint16{0x0304, 0x0303}; !reflect.DeepEqual(info.SupportedVersions, want) {
+		t.Fatalf("SupportedVersions = %#x, want %#x", info.SupportedVersions, want)
+	}
+	if want := []string{"h2", "http/1.1"}; !reflect.DeepEqual(info.SupportedProtos, want) {
+		t.Fatalf("SupportedProtos = %q, want %q", info.SupportedProtos, want)
+	}
+	var types []uint16
+	for _, ext := range info.Extensions {
+		types = append(types, ext.Type)
+	}
+	if want := []uint16{0x0000, 0x0010, 0x002b}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("extension types = %#x, want %#x", types, want)
+	}
+}
+
+func TestTLSClientHelloRecords(t *testing.T) {
+	msg := clientHello([]uint16{0x1301, 0xc02f}, sniExt("a.example"), alpnExt("h2"))
+	want := parseHello(t, records(msg))
+
+	tests := []struct {
+		name  string
+		sizes []int
+	}{
+		{"two records", []int{40}},
+		{"three records", []int{30, 30}},
+		// the first record doesn't even hold the handshake header
+		{"short first record", []int{2, 50}},
+		{"one byte records", []int{1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseHello(t, records(msg, tt.sizes...)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("parsed %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestTLSClientHelloMalformed(t *testing.T) {
+	suites := []uint16{0x1301}
+	msg := clientHello(suites, sniExt("a.example"))
+
+	// extensions vector whose length runs past the message
+	overlong := append([]byte{}, msg...)
+	extsOff := 4 + 2 + 32 + 1 + 2 + 2*len(suites) + 2
+	overlong[extsOff+1] += 8
+
+	// second record isn't a handshake record
+	alert := records(msg, 20)
+	alert[5+20] = 0x15
+
+	notHello := append([]byte{}, msg...)
+	notHello[0] = 0x02 // ServerHello
+
+	data := records(msg, 20)
+
+	runDetectTests(t, munproto.TLSClientHello(func(munproto.ClientHelloInfo) bool { return true }), []detectTest{
+		{"overlong extension", string(records(clientHello(suites, []byte{0x00, 0x00, 0x01, 0x00, 'a'}))), false, nil},
+		{"truncated extension header", string(records(clientHello(suites, []byte{0x00, 0x00, 0x00}))), false, nil},
+		{"overlong extensions", string(records(overlong)), false, nil},
+		{"non-handshake record", string(alert), false, nil},
+		{"not a ClientHello", string(records(notHello)), false, nil},
+		{"http", "GET / HTTP/1.1\r\n\r\n", false, nil},
+		{"truncated record", string(data[:len(data)-5]), false, io.EOF},
+		{"truncated second header", string(data[:5+20+3]), false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestTLSClientHelloUnconsumed(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddProto("a.example", munproto.TLSClientHello(func(info munproto.ClientHelloInfo) bool {
+		return info.ServerName == "a.example"
+	}))
+	l := d.Listener("a.example")
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := append(records(clientHello([]uint16{0x1301}, sniExt("a.example")), 30), "tail"...)
+	go conn.Write(data)
+
+	delivered := acceptWithin(t, l, time.Second)
+	defer delivered.Close()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(delivered, got); err != nil || string(got) != string(data) {
+		t.Fatalf("delivered conn read %q, %v, want all records and the tail", got, err)
+	}
+}
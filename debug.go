@@ -0,0 +1,138 @@
+package munproto
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DebugState is the state rendered by DebugHandler.
+type DebugState struct {
+	Uptime time.Duration
+	// incremented with every change of the protos or their evaluation order, e.g. by ReplaceProtos
+	Generation uint64
+	// registered protos, the evaluated ones first in evaluation order, then the others by name
+	Protos []DebugProto
+	Stats  Stats
+	// see RecentErrors
+	Errors []ErrorRecord
+}
+
+// DebugProto is the state of a proto in DebugState.
+type DebugProto struct {
+	Name        string
+	Description string
+	// evaluated during detection, i.e. it has a listener or is forwarded
+	Evaluated bool
+	Forwarded bool
+	// set by RequireTLS
+	RequireTLS bool
+	// the detection timeout of the proto, zero if it uses the dispatcher timeout
+	Timeout time.Duration
+	// the limits of WithRateLimit in bytes per second and WithHighWater, zero if unlimited
+	ReadLimit  int64
+	WriteLimit int64
+	HighWater  int
+	Stats      ProtoStats
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html><head><title>munproto</title></head><body>
+<p>uptime {{.Uptime}}, generation {{.Generation}}, dispatched {{.Stats.Dispatched}}, delivered {{.Stats.Delivered}}, unmatched {{.Stats.Unmatched}},
+detect errors {{.Stats.DetectErrors}}, denied {{.Stats.Denied}}, forwarded {{.Stats.Forwarded}}</p>
+<table border="1">
+<tr><th>proto</th><th>description</th><th>evaluated</th><th>forwarded</th><th>require tls</th><th>timeout</th><th>read limit</th><th>write limit</th>
+<th>high water</th><th>matched</th><th>unmatched</th><th>detect errors</th><th>delivered</th><th>accepted</th><th>pending</th><th>max pending</th><th>read rate</th>
+<th>write rate</th></tr>
+{{range .Protos}}<tr><td>{{.Name}}</td><td>{{.Description}}</td><td>{{.Evaluated}}</td><td>{{.Forwarded}}</td><td>{{.RequireTLS}}</td><td>{{.Timeout}}</td>
+<td>{{.ReadLimit}}</td><td>{{.WriteLimit}}</td><td>{{.HighWater}}</td><td>{{.Stats.Matched}}</td><td>{{.Stats.Unmatched}}</td>
+<td>{{.Stats.DetectErrors}}</td><td>{{.Stats.Delivered}}</td>
+<td>{{.Stats.Accepted}}</td><td>{{.Stats.Pending}}</td><td>{{.Stats.MaxPending}}</td>
+<td>{{printf "%.0f" .Stats.ReadRate}}</td><td>{{printf "%.0f" .Stats.WriteRate}}</td></tr>
+{{end}}</table>
+{{if .Errors}}<h2>recent errors</h2>
+<table border="1">
+<tr><th>time</th><th>conn</th><th>remote</th><th>proto</th><th>error</th><th>data</th></tr>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02T15:04:05.000Z07:00"}}</td><td>{{.ConnID}}</td><td>{{.RemoteAddr}}</td><td>{{.Proto}}</td>
+<td>{{.Err}}</td><td><code>{{printf "%x" .Data}}</code></td></tr>
+{{end}}</table>{{end}}
+</body></html>
+`))
+
+// return a snapshot of the state of the dispatcher, as rendered by DebugHandler.
+func (self *Dispatcher) DebugState() DebugState {
+	state := DebugState{
+		Uptime: time.Since(self.started),
+		Stats:  self.Stats(),
+		Errors: self.RecentErrors(),
+	}
+
+	self.mu.RLock()
+	state.Generation = self.set.generation
+	evaluated := make(map[string]bool, len(self.lorder))
+	for _, name := range self.lorder {
+		evaluated[name] = true
+		state.Protos = append(state.Protos, self.debugProto(name))
+	}
+
+	var rest []string
+	for name := range self.protos {
+		if !evaluated[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		state.Protos = append(state.Protos, self.debugProto(name))
+	}
+	self.mu.RUnlock()
+
+	for i := range state.Protos {
+		p := &state.Protos[i]
+		p.Evaluated = evaluated[p.Name]
+		p.Stats = state.Stats.Protos[p.Name]
+	}
+	return state
+}
+
+// must be called with mu held
+func (self *Dispatcher) debugProto(name string) DebugProto {
+	p := self.protos[name]
+	_, forwarded := self.forwards[name]
+
+	highWater := p.highWater
+	if highWater == 0 {
+		highWater = self.highWater
+	}
+	return DebugProto{
+		Name:        name,
+		Description: p.info.Description,
+		Forwarded:   forwarded,
+		RequireTLS:  p.requireTLS,
+		Timeout:     p.timeout,
+		ReadLimit:   p.readRate,
+		WriteLimit:  p.writeRate,
+		HighWater:   highWater,
+	}
+}
+
+// create handler which renders DebugState as HTML table, or as JSON if requested with ?format=json or the Accept
+// header. Besides counters and configuration it contains the remote addresses and first bytes of the recent errors,
+// unless they are disabled by WithRecentErrors, so it should only be mounted on an internal admin mux.
+func (self *Dispatcher) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := self.DebugState()
+
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		debugTemplate.Execute(w, state)
+	})
+}
@@ -0,0 +1,169 @@
+package munproto_test
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// the JSON keys of DebugHandler, changing them breaks the dashboards built on it
+var debugSchema = map[string][]string{
+	"state": {"Errors", "Generation", "Protos", "Stats", "Uptime"},
+	"stats": {"Delivered", "Denied", "DetectErrors", "Dispatched", "DumpsDropped", "Empty", "ForwardErrors",
+		"Forwarded", "IdleClosed", "MaxAgeClosed", "Panics", "Protos", "QueueRejected", "RejectFailures", "RejectResponses",
+		"Unmatched"},
+	"proto": {"Description", "Evaluated", "Forwarded", "HighWater", "Name", "ReadLimit", "RequireTLS", "Stats",
+		"Timeout", "WriteLimit"},
+	"proto stats": {"Accepted", "Delivered", "DetectErrors", "Matched", "MaxPending", "Pending", "ReadRate",
+		"Unmatched", "WriteRate"},
+	"error": {"ConnID", "Data", "Err", "Proto", "RemoteAddr", "Time"},
+}
+
+func keys(m map[string]json.RawMessage) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func checkKeys(t *testing.T, name string, data json.RawMessage) map[string]json.RawMessage {
+	t.Helper()
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if got, want := strings.Join(keys(m), ","), strings.Join(debugSchema[name], ","); got != want {
+		t.Errorf("%s keys = %s, want %s", name, got, want)
+	}
+	return m
+}
+
+// send data over a new conn and wait until it was logged
+func dispatchData(t *testing.T, pl *munprototest.PipeListener, logged chan struct{}, data string) {
+	t.Helper()
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte(data))
+
+	select {
+	case <-logged:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("conn %q wasn't logged", data)
+	}
+}
+
+func debugDispatcher(t *testing.T) (*munproto.Dispatcher, *munprototest.PipeListener, chan struct{}) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, 50*time.Millisecond)
+	d.AddProto("socks5", munproto.IsSOCKS5)
+	d.AddProto("http", munproto.IsHTTP)
+	for _, name := range []string{"socks5", "http"} {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}(d.Listener(name))
+	}
+
+	logged := make(chan struct{}, 16)
+	d.AccessLog = func(rec munproto.DispatchRecord) {
+		logged <- struct{}{}
+	}
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, pl, logged
+}
+
+func TestDebugCounters(t *testing.T) {
+	d, pl, logged := debugDispatcher(t)
+
+	dispatchData(t, pl, logged, "GET / HTTP/1.1\r\n\r\n")
+	dispatchData(t, pl, logged, "\x05\x01\x00")
+	// times out in the http detector
+	dispatchData(t, pl, logged, "GE")
+	dispatchData(t, pl, logged, "\x00\x01\x02\x03\x04\x05\x06\x07")
+
+	want := map[string][3]int64{
+		"socks5": {1, 3, 0},
+		"http":   {1, 1, 1},
+	}
+	for _, p := range d.DebugState().Protos {
+		got := [3]int64{p.Stats.Matched, p.Stats.Unmatched, p.Stats.DetectErrors}
+		if got != want[p.Name] {
+			t.Errorf("%s matched, unmatched, errors = %v, want %v", p.Name, got, want[p.Name])
+		}
+	}
+}
+
+func TestDebugCountersSurviveTrace(t *testing.T) {
+	d, pl, logged := debugDispatcher(t)
+
+	dispatchData(t, pl, logged, "\x05\x01\x00")
+	// Trace replaces the proto
+	if err := d.Trace("socks5", 16, func(munproto.TraceRecord) {}); err != nil {
+		t.Fatal(err)
+	}
+	dispatchData(t, pl, logged, "\x05\x01\x00")
+
+	if got := d.Stats().Protos["socks5"].Matched; got != 2 {
+		t.Fatalf("socks5 matched = %d, want 2", got)
+	}
+}
+
+func TestDebugHandlerJSON(t *testing.T) {
+	d, pl, logged := debugDispatcher(t)
+	dispatchData(t, pl, logged, "GET / HTTP/1.1\r\n\r\n")
+	dispatchData(t, pl, logged, "\x00\x01\x02\x03\x04\x05\x06\x07")
+
+	w := httptest.NewRecorder()
+	d.DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug?format=json", nil))
+
+	resp := w.Result()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	state := checkKeys(t, "state", body)
+	stats := checkKeys(t, "stats", state["Stats"])
+	var protoStats map[string]json.RawMessage
+	if err := json.Unmarshal(stats["Protos"], &protoStats); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, "proto stats", protoStats["http"])
+
+	var protos, errs []json.RawMessage
+	if err := json.Unmarshal(state["Protos"], &protos); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(state["Errors"], &errs); err != nil {
+		t.Fatal(err)
+	}
+	if len(protos) != 2 || len(errs) == 0 {
+		t.Fatalf("%d protos and %d errors, want 2 and at least 1", len(protos), len(errs))
+	}
+	for _, p := range protos {
+		checkKeys(t, "proto stats", checkKeys(t, "proto", p)["Stats"])
+	}
+	for _, e := range errs {
+		checkKeys(t, "error", e)
+	}
+}
@@ -0,0 +1,647 @@
+package munproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OpenVPN opcodes of the packets a client starts the session with
+const (
+	openVPNHardResetClientV2 = 7
+	openVPNHardResetClientV3 = 10
+)
+
+// detect OpenVPN in TCP mode: a 2 byte packet length followed by the opcode of the initial client reset packet
+// (P_CONTROL_HARD_RESET_CLIENT_V2 or V3).
+func IsOpenVPN(r *bufio.Reader) (bool, error) {
+	data, err := r.Peek(3)
+	if err != nil {
+		return false, err
+	}
+
+	length := binary.BigEndian.Uint16(data)
+	if length < 14 || length > 200 {
+		return false, nil
+	}
+
+	opcode := data[2] >> 3
+	return opcode == openVPNHardResetClientV2 || opcode == openVPNHardResetClientV3, nil
+}
+
+// detect a ClientHello in the SSLv2 compatible format, which is still sent by ancient clients and some scanners: a
+// 2 byte record header with the high bit set, message type CLIENT-HELLO and a version of SSL 3.0 or later.
+func IsSSLv2ClientHello(r *bufio.Reader) (bool, error) {
+	data, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if data[0] != 0x80 && data[0] != 0x81 {
+		return false, nil
+	}
+
+	if data, err = r.Peek(5); err != nil {
+		return false, err
+	}
+
+	length := int(data[0]&0x7f)<<8 | int(data[1])
+	return length >= 3 && data[2] == 0x01 && data[3] >= 0x03, nil
+}
+
+// TDS packet types a client starts with
+const (
+	tdsPreLogin = 0x12
+	tdsLogin    = 0x10
+)
+
+// detect a MS SQL Server (TDS) client: a PRELOGIN packet header with status EOM, a plausible length and zero SPID
+// and window.
+func IsTDS(r *bufio.Reader) (bool, error) {
+	return detectTDS(r, false)
+}
+
+// create a TDS detector like IsTDS, which with legacyLogin also matches the LOGIN packet of pre-7.0 clients.
+func TDS(legacyLogin bool) func(*bufio.Reader) (bool, error) {
+	return func(r *bufio.Reader) (bool, error) {
+		return detectTDS(r, legacyLogin)
+	}
+}
+
+func detectTDS(r *bufio.Reader, legacyLogin bool) (bool, error) {
+	data, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if data[0] != tdsPreLogin && !(legacyLogin && data[0] == tdsLogin) {
+		return false, nil
+	}
+
+	if data, err = r.Peek(8); err != nil {
+		return false, err
+	}
+
+	length := binary.BigEndian.Uint16(data[2:])
+	spid := binary.BigEndian.Uint16(data[4:])
+	return data[1] == 0x01 && length >= 8 && length <= 32768 && spid == 0 && data[7] == 0, nil
+}
+
+// CQL opcodes a client starts with
+const (
+	cqlStartup = 0x01
+	cqlOptions = 0x05
+)
+
+// detect a Cassandra CQL native protocol client (v3 to v5): a request frame header without flags, with the STARTUP
+// or OPTIONS opcode and a body of at most 64KB. The version byte is 0x03 to 0x05, so the first byte of v4 and v5
+// frames is the first byte of SOCKS4 and SOCKS5, which match on it alone: IsCQL must be evaluated before "socks4"
+// and "socks5". Their second byte is never zero, so the short SOCKS greetings are rejected without waiting for the
+// whole frame header.
+func IsCQL(r *bufio.Reader) (bool, error) {
+	data, err := r.Peek(2)
+	if len(data) > 0 && (data[0] < 0x03 || data[0] > 0x05) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if data[1] != 0 {
+		return false, nil
+	}
+
+	if data, err = r.Peek(9); err != nil {
+		return false, err
+	}
+
+	opcode := data[4]
+	length := binary.BigEndian.Uint32(data[5:])
+	return (opcode == cqlStartup || opcode == cqlOptions) && length <= 1<<16, nil
+}
+
+// detect a RDP client: a TPKT header (version 3) carrying a X.224 Connection Request which fills the packet. RTMP
+// handshakes start with 0x03 too, the reserved byte, the length and the CR code tell them apart.
+func IsRDP(r *bufio.Reader) (bool, error) {
+	data, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if data[0] != 0x03 {
+		return false, nil
+	}
+
+	if data, err = r.Peek(7); err != nil {
+		return false, err
+	}
+
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	return data[1] == 0 && length >= 11 && int(data[4]) == length-5 && data[5]&0xf0 == 0xe0, nil
+}
+
+// telnet commands
+const (
+	telnetIAC  = 0xff
+	telnetWILL = 0xfb
+	telnetDONT = 0xfe
+)
+
+// detect a telnet client starting with option negotiation: IAC followed by WILL, WONT, DO or DONT and an option.
+// Clients which start with plain text, like many automation tools, don't match.
+func IsTelnet(r *bufio.Reader) (bool, error) {
+	return detectTelnet(r, 1)
+}
+
+// create a telnet detector like IsTelnet, which with strict requires two consecutive negotiations.
+func Telnet(strict bool) func(*bufio.Reader) (bool, error) {
+	n := 1
+	if strict {
+		n = 2
+	}
+	return func(r *bufio.Reader) (bool, error) {
+		return detectTelnet(r, n)
+	}
+}
+
+func detectTelnet(r *bufio.Reader, n int) (bool, error) {
+	data, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if data[0] != telnetIAC {
+		return false, nil
+	}
+
+	if data, err = r.Peek(3 * n); err != nil {
+		return false, err
+	}
+
+	for i := 0; i < n; i++ {
+		if data[3*i] != telnetIAC || data[3*i+1] < telnetWILL || data[3*i+1] > telnetDONT {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// the commands of the git daemon protocol, with the separating space
+var gitCommands = []string{"git-upload-pack ", "git-receive-pack ", "git-upload-archive "}
+
+// detect a git daemon client (git://): a pkt-line with a 4 hex digits length and one of the commands
+// git-upload-pack, git-receive-pack and git-upload-archive.
+func IsGit(r *bufio.Reader) (bool, error) {
+	data, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if !isLowerHex(data[0]) {
+		return false, nil
+	}
+
+	if data, err = r.Peek(8); err != nil {
+		return false, err
+	}
+	for _, c := range data[:4] {
+		if !isLowerHex(c) {
+			return false, nil
+		}
+	}
+	if string(data[4:]) != "git-" {
+		return false, nil
+	}
+
+	length, _ := strconv.ParseUint(string(data[:4]), 16, 16)
+	n := 4 + len("git-upload-archive ")
+	if int(length) < n {
+		n = int(length)
+	}
+	if data, err = r.Peek(n); err != nil {
+		return false, err
+	}
+
+	for _, cmd := range gitCommands {
+		if strings.HasPrefix(string(data[4:]), cmd) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isLowerHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f'
+}
+
+// the greeting of rsync daemon clients, followed by the protocol version
+const rsyncGreeting = "@RSYNCD: "
+
+var rsyncPrefix = MaskedPrefix([]byte(rsyncGreeting), bytes.Repeat([]byte{0xff}, len(rsyncGreeting)))
+
+// detect a rsync daemon client (rsync://), which speaks first with "@RSYNCD: <version>\n".
+func IsRsync(r *bufio.Reader) (bool, error) {
+	return rsyncPrefix(r)
+}
+
+// detect syslog over TCP (RFC 6587), with octet-counting ("123 <34>1 ...") or non-transparent framing ("<34>...").
+// The numeric PRI and the closing '>' must be within 5 bytes, so XML doesn't match.
+func IsSyslog(r *bufio.Reader) (bool, error) {
+	return DataDetector(syslogData).Detect(r)
+}
+
+func syslogData(data []byte) (Result, int) {
+	i := 0
+	for ; i < len(data) && i < 10 && isDigit(data[i]); i++ {
+		if i == 0 && data[i] == '0' {
+			return NoMatch, 0
+		}
+	}
+	if i == len(data) {
+		return NeedMore, 1
+	}
+	if i > 0 {
+		if data[i] != ' ' {
+			return NoMatch, 0
+		}
+		i++
+	}
+	return syslogPRI(data[i:])
+}
+
+// match "<PRI>" with 1 to 3 digits.
+func syslogPRI(data []byte) (Result, int) {
+	for i := 0; i < 5; i++ {
+		if i == len(data) {
+			return NeedMore, 1
+		}
+
+		c := data[i]
+		switch {
+		case i == 0:
+			if c != '<' {
+				return NoMatch, 0
+			}
+		case c == '>':
+			if i == 1 {
+				return NoMatch, 0
+			}
+			return Match, 0
+		case !isDigit(c):
+			return NoMatch, 0
+		}
+	}
+	return NoMatch, 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// the peek limit of IsGraphite
+const defaultGraphiteLimit = 512
+
+// detect the graphite plaintext protocol, "metric.path value timestamp\n", within the first 512 bytes.
+func IsGraphite(r *bufio.Reader) (bool, error) {
+	return Graphite(defaultGraphiteLimit)(r)
+}
+
+// create a graphite detector like IsGraphite, which looks for the end of the first line within max bytes. There are
+// no magic bytes, the line must have three fields with numeric value and timestamp, and conns with non printable
+// bytes are rejected early. It should be evaluated after the protos with a structured start.
+func Graphite(max int) func(*bufio.Reader) (bool, error) {
+	return DataDetector(func(data []byte) (Result, int) {
+		for i, c := range data {
+			if i >= max {
+				return NoMatch, 0
+			}
+			if c == '\n' {
+				return graphiteLine(string(data[:i])), 0
+			}
+			if c < 0x20 && c != '\r' || c > 0x7e {
+				return NoMatch, 0
+			}
+		}
+		return NeedMore, 1
+	}).Detect
+}
+
+func graphiteLine(line string) Result {
+	fields := strings.Split(strings.TrimSuffix(line, "\r"), " ")
+	if len(fields) != 3 || fields[0] == "" {
+		return NoMatch
+	}
+	for _, field := range fields[1:] {
+		if _, err := strconv.ParseFloat(field, 64); err != nil {
+			return NoMatch
+		}
+	}
+	return Match
+}
+
+// detect a Beats client speaking Lumberjack v2: the version byte '2' followed by the frame type 'W', 'C', 'J' or
+// 'D'. Both bytes are printable, so it should be evaluated before text protos like IsGraphite.
+func IsLumberjack(r *bufio.Reader) (bool, error) {
+	return detectLumberjack(r, false)
+}
+
+// create a Lumberjack detector like IsLumberjack, which with v1 also matches the frames of Lumberjack v1.
+func Lumberjack(v1 bool) func(*bufio.Reader) (bool, error) {
+	return func(r *bufio.Reader) (bool, error) {
+		return detectLumberjack(r, v1)
+	}
+}
+
+func detectLumberjack(r *bufio.Reader, v1 bool) (bool, error) {
+	data, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if data[0] != '2' && !(v1 && data[0] == '1') {
+		return false, nil
+	}
+
+	if data, err = r.Peek(2); err != nil {
+		return false, err
+	}
+
+	switch data[1] {
+	case 'W', 'C', 'D':
+		return true, nil
+	case 'J':
+		return data[0] == '2', nil
+	}
+	return false, nil
+}
+
+// the msgpack nil, sent by fluentd forward clients as heartbeat
+const msgpackNil = 0xc0
+
+// detect a fluentd forward protocol client: a msgpack array of 2 to 4 elements starting with a string, the tag.
+func IsFluentForward(r *bufio.Reader) (bool, error) {
+	return detectFluentForward(r, false)
+}
+
+// create a fluentd forward detector like IsFluentForward, which with heartbeat also matches conns starting with the
+// msgpack nil heartbeat.
+func FluentForward(heartbeat bool) func(*bufio.Reader) (bool, error) {
+	return func(r *bufio.Reader) (bool, error) {
+		return detectFluentForward(r, heartbeat)
+	}
+}
+
+func detectFluentForward(r *bufio.Reader, heartbeat bool) (bool, error) {
+	data, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if heartbeat && data[0] == msgpackNil {
+		return true, nil
+	}
+	if data[0] < 0x92 || data[0] > 0x94 {
+		return false, nil
+	}
+
+	if data, err = r.Peek(2); err != nil {
+		return false, err
+	}
+
+	// fixstr, str 8, str 16 or str 32
+	c := data[1]
+	return c >= 0xa0 && c <= 0xbf || c >= 0xd9 && c <= 0xdb, nil
+}
+
+// the ZMTP signature: 0xFF, 8 bytes of padding and 0x7F. The padding is zero except for its last byte, which ZMTP 1.0
+// compatible peers set to the length of the identity.
+var zmtpSignature = MaskedPrefix(
+	[]byte{0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0x7f},
+	[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0xff},
+)
+
+// detect a ZeroMQ (ZMTP 3.x) peer by the 10 byte signature, without waiting for the version which follows it. The
+// signature is checked as the bytes arrive, so telnet negotiation, which starts with 0xFF too, is rejected at its
+// second byte.
+func IsZMTP(r *bufio.Reader) (bool, error) {
+	return zmtpSignature(r)
+}
+
+// create a detector which matches conns starting with a JSON object or array, after optional whitespace. If require
+// is given, any of the substrings, e.g. `"jsonrpc"`, must appear within the first maxPeek bytes as well, the peek
+// grows as fragments arrive until one is found or the limit is hit. Panics if maxPeek isn't positive.
+func IsJSON(maxPeek int, require ...string) func(*bufio.Reader) (bool, error) {
+	if maxPeek <= 0 {
+		panic(fmt.Sprintf("munproto: invalid JSON peek limit: %d", maxPeek))
+	}
+
+	keys := make([][]byte, len(require))
+	for i, key := range require {
+		keys[i] = []byte(key)
+	}
+
+	return DataDetector(func(data []byte) (Result, int) {
+		if len(data) > maxPeek {
+			data = data[:maxPeek]
+		}
+
+		trimmed := bytes.TrimLeft(data, " \t\r\n")
+		if len(trimmed) == 0 {
+			if len(data) == maxPeek {
+				return NoMatch, 0
+			}
+			return NeedMore, 1
+		}
+		if trimmed[0] != '{' && trimmed[0] != '[' {
+			return NoMatch, 0
+		}
+		if len(keys) == 0 {
+			return Match, 0
+		}
+
+		for _, key := range keys {
+			if bytes.Contains(trimmed, key) {
+				return Match, 0
+			}
+		}
+		if len(data) == maxPeek {
+			return NoMatch, 0
+		}
+		return NeedMore, 1
+	}).Detect
+}
+
+// the commands IRC clients register with
+var ircCommands = []string{"CAP", "NICK", "USER", "PASS"}
+
+// detect an IRC client: the first command is CAP, NICK, USER or PASS, uppercase and followed by a space. FTP clients
+// send "USER" too, but only after the greeting of the server, so they never reach detection.
+func IsIRC(r *bufio.Reader) (bool, error) {
+	return DataDetector(func(data []byte) (Result, int) {
+		for i, c := range data {
+			if c == ' ' {
+				for _, cmd := range ircCommands {
+					if string(data[:i]) == cmd {
+						return Match, 0
+					}
+				}
+				return NoMatch, 0
+			}
+			if c < 'A' || c > 'Z' || i >= 4 {
+				return NoMatch, 0
+			}
+		}
+		return NeedMore, 1
+	}).Detect(r)
+}
+
+// detect a Modbus TCP client: a MBAP header with protocol id 0, a length of 2 to 254 and a function code of 1 to 127.
+// The header has no magic bytes and needs 8 bytes, so it should be evaluated after all protos which can decide
+// earlier, in particular the short SOCKS greetings.
+func IsModbus(r *bufio.Reader) (bool, error) {
+	return detectModbus(r, false)
+}
+
+// create a Modbus detector like IsModbus, which with strict only accepts the public function codes up to 0x2B.
+func Modbus(strict bool) func(*bufio.Reader) (bool, error) {
+	return func(r *bufio.Reader) (bool, error) {
+		return detectModbus(r, strict)
+	}
+}
+
+func detectModbus(r *bufio.Reader, strict bool) (bool, error) {
+	data, err := r.Peek(4)
+	if len(data) > 2 && data[2] != 0 || len(data) > 3 && data[3] != 0 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if data, err = r.Peek(8); err != nil {
+		return false, err
+	}
+
+	length := binary.BigEndian.Uint16(data[4:])
+	maxCode := byte(0x7f)
+	if strict {
+		maxCode = 0x2b
+	}
+	fc := data[7]
+	return length >= 2 && length <= 254 && fc >= 1 && fc <= maxCode, nil
+}
+
+// the marker of BGP messages
+var bgpMarker = MaskedPrefix(bytes.Repeat([]byte{0xff}, 16), bytes.Repeat([]byte{0xff}, 16))
+
+// detect a BGP speaker: an OPEN message with the all ones marker, a length of 29 to 4096 bytes and type 1. The
+// marker is checked as the bytes arrive, so other protos starting with 0xFF are rejected at their first differing
+// byte.
+func IsBGP(r *bufio.Reader) (bool, error) {
+	if ok, err := bgpMarker(r); !ok || err != nil {
+		return false, err
+	}
+
+	data, err := r.Peek(19)
+	if err != nil {
+		return false, err
+	}
+
+	length := binary.BigEndian.Uint16(data[16:])
+	return length >= 29 && length <= 4096 && data[18] == 0x01, nil
+}
+
+// SMPP command ids, see SMPP
+const (
+	SMPPBindReceiver    uint32 = 0x00000001
+	SMPPBindTransmitter uint32 = 0x00000002
+	SMPPBindTransceiver uint32 = 0x00000009
+	SMPPEnquireLink     uint32 = 0x00000015
+)
+
+var isSMPP = SMPP(SMPPBindReceiver, SMPPBindTransmitter, SMPPBindTransceiver)
+
+// detect a SMPP client starting with a bind PDU: a length of 16 to 512 bytes, a bind command id and status 0.
+func IsSMPP(r *bufio.Reader) (bool, error) {
+	return isSMPP(r)
+}
+
+// create a SMPP detector like IsSMPP, which matches the first PDU against commandIDs instead of the binds, e.g. to
+// accept clients which send SMPPEnquireLink first.
+func SMPP(commandIDs ...uint32) func(*bufio.Reader) (bool, error) {
+	commandIDs = append([]uint32{}, commandIDs...)
+
+	return func(r *bufio.Reader) (bool, error) {
+		data, err := r.Peek(1)
+		if err != nil {
+			return false, err
+		}
+		if data[0] != 0 {
+			return false, nil
+		}
+
+		if data, err = r.Peek(16); err != nil {
+			return false, err
+		}
+
+		length := binary.BigEndian.Uint32(data)
+		if length < 16 || length > 512 || binary.BigEndian.Uint32(data[8:]) != 0 {
+			return false, nil
+		}
+
+		id := binary.BigEndian.Uint32(data[4:])
+		for _, commandID := range commandIDs {
+			if id == commandID {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// the client name prefix of the Hello packets of ClickHouse clients
+const clickHouseName = "ClickHouse"
+
+// detect a ClickHouse native protocol client: a Hello packet, packet id 0 followed by the client name, which starts
+// with "ClickHouse".
+func IsClickHouse(r *bufio.Reader) (bool, error) {
+	return detectClickHouse(r, false)
+}
+
+// create a ClickHouse detector like IsClickHouse, which with anyName also matches Hello packets with other client
+// names, e.g. "clickhouse-go", as long as the name is printable and shorter than 128 bytes. This is much weaker, as
+// only the first byte is fixed.
+func ClickHouse(anyName bool) func(*bufio.Reader) (bool, error) {
+	return func(r *bufio.Reader) (bool, error) {
+		return detectClickHouse(r, anyName)
+	}
+}
+
+func detectClickHouse(r *bufio.Reader, anyName bool) (bool, error) {
+	data, err := r.Peek(2)
+	if len(data) > 0 && data[0] != 0 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// a single byte varint, names of 128 bytes or longer aren't plausible
+	length := int(data[1])
+	if length == 0 || length >= 0x80 || !anyName && length < len(clickHouseName) {
+		return false, nil
+	}
+
+	if !anyName {
+		length = len(clickHouseName)
+	}
+	if data, err = r.Peek(2 + length); err != nil {
+		return false, err
+	}
+
+	name := data[2:]
+	if !anyName {
+		return string(name) == clickHouseName, nil
+	}
+	for _, c := range name {
+		if c < 0x20 || c > 0x7e {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,633 @@
+package munproto_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+type detectTest struct {
+	name    string
+	data    string
+	want    bool
+	wantErr error
+}
+
+func runDetectTests(t *testing.T, detect func(*bufio.Reader) (bool, error), tests []detectTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := munprototest.DetectBytes(detect, []byte(tt.data))
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("detect(%q) = %v, %v, want %v, %v", tt.data, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsOpenVPN(t *testing.T) {
+	runDetectTests(t, munproto.IsOpenVPN, []detectTest{
+		// OpenVPN 2.6 client without tls-auth: P_CONTROL_HARD_RESET_CLIENT_V2, session id, no acks, packet id 0
+		{"hard reset v2", "\x00\x0e\x38\x4f\x91\x2b\x6a\xd0\x17\xe3\x55\x00\x00\x00\x00\x00", true, nil},
+		// the same with tls-auth, HMAC-SHA1 and replay protection
+		{"hard reset v2 tls-auth", "\x00\x36\x38\x4f\x91\x2b\x6a\xd0\x17\xe3\x55", true, nil},
+		// P_CONTROL_HARD_RESET_CLIENT_V3 with key id 0
+		{"hard reset v3", "\x00\x58\x50\xa1\x02\x03\x04\x05\x06\x07\x08", true, nil},
+		{"server reset", "\x00\x0e\x40", false, nil},
+		{"data packet", "\x00\x0e\x48", false, nil},
+		{"too short", "\x00\x0d\x38", false, nil},
+		{"too long", "\x00\xc9\x38", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"tls", "\x16\x03\x01\x02\x00\x01", false, nil},
+		{"short", "\x00\x0e", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestIsSSLv2ClientHello(t *testing.T) {
+	runDetectTests(t, munproto.IsSSLv2ClientHello, []detectTest{
+		// openssl s_client -ssl2 compatible hello offering TLS 1.0: length 46, CLIENT-HELLO, version 3.1, spec length 21
+		{"tls 1.0", "\x80\x2e\x01\x03\x01\x00\x15\x00\x00\x00\x10", true, nil},
+		{"ssl 3.0", "\x80\x2e\x01\x03\x00\x00\x15\x00\x00\x00\x10", true, nil},
+		// hellos of 256 bytes and more set the low bit of the first byte
+		{"long hello", "\x81\x2e\x01\x03\x01\x00\x15", true, nil},
+		{"ssl 2.0 only", "\x80\x2e\x01\x00\x02\x00\x15\x00\x00\x00\x10", false, nil},
+		{"server hello", "\x80\x2e\x04\x00\x01\x03\x01", false, nil},
+		{"too short", "\x80\x02\x01\x03\x01", false, nil},
+		{"tls record", "\x16\x03\x01\x00\xa5\x01\x00\x00\xa1\x03\x03", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial", "\x80\x2e\x01", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestIsTDS(t *testing.T) {
+	// sqlcmd 16: PRELOGIN with the VERSION, ENCRYPTION, INSTOPT, THREADID and MARS options
+	prelogin := "\x12\x01\x00\x2f\x00\x00\x01\x00" +
+		"\x00\x00\x1a\x00\x06\x01\x00\x20\x00\x01\x02\x00\x21\x00\x01\x03\x00\x22\x00\x04\x04\x00\x26\x00\x01\xff" +
+		"\x10\x00\x07\xd0\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	// a TDS 4.2 client, which logs in without PRELOGIN
+	login := "\x10\x01\x02\x00\x00\x00\x01\x00"
+
+	runDetectTests(t, munproto.IsTDS, []detectTest{
+		{"prelogin", prelogin, true, nil},
+		{"legacy login", login, false, nil},
+		{"not end of message", "\x12\x00\x00\x2f\x00\x00\x01\x00", false, nil},
+		{"short length", "\x12\x01\x00\x04\x00\x00\x01\x00", false, nil},
+		{"long length", "\x12\x01\x80\x01\x00\x00\x01\x00", false, nil},
+		{"spid", "\x12\x01\x00\x2f\x00\x35\x01\x00", false, nil},
+		{"window", "\x12\x01\x00\x2f\x00\x00\x01\x01", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial", "\x12\x01\x00\x2f", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.TDS(true), []detectTest{
+		{"legacy login", login, true, nil},
+		{"prelogin", prelogin, true, nil},
+		{"partial login", "\x10\x01", false, io.EOF},
+	})
+}
+
+// start a dispatcher evaluating the built-in protos in the given order, the returned func sends data over a new conn
+// and returns the proto it was delivered to, or UnmatchedProto if it was closed.
+func router(t *testing.T, protos ...string) func(t *testing.T, data string) string {
+	t.Helper()
+	builtin := map[string]munproto.ProtoInfo{}
+	for _, info := range munproto.BuiltinProtos() {
+		builtin[info.Name] = info
+	}
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	delivered := make(chan string)
+	for _, name := range protos {
+		info, ok := builtin[name]
+		if !ok {
+			t.Fatalf("no built-in proto %s", name)
+		}
+		d.AddProtoInfo(info)
+		l := d.Listener(name)
+		go func(name string) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				delivered <- name
+			}
+		}(name)
+	}
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+
+	return func(t *testing.T, data string) string {
+		t.Helper()
+		conn, err := pl.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go conn.Write([]byte(data))
+
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, conn)
+			close(closed)
+		}()
+
+		select {
+		case name := <-delivered:
+			return name
+		case <-closed:
+			return munproto.UnmatchedProto
+		case <-time.After(2 * time.Second):
+			t.Fatalf("conn %q neither delivered nor closed", data)
+			return ""
+		}
+	}
+}
+
+func TestIsCQL(t *testing.T) {
+	runDetectTests(t, munproto.IsCQL, []detectTest{
+		// the drivers probe with OPTIONS: version, flags, stream 0, opcode, empty body
+		{"v4 options", "\x04\x00\x00\x00\x05\x00\x00\x00\x00", true, nil},
+		{"v4 startup", "\x04\x00\x00\x01\x01\x00\x00\x00\x16\x00\x01\x00\x0bCQL_VERSION", true, nil},
+		{"v5 options", "\x05\x00\x00\x00\x05\x00\x00\x00\x00", true, nil},
+		{"v3 startup", "\x03\x00\x00\x01\x01\x00\x00\x00\x16", true, nil},
+		{"v2", "\x02\x00\x00\x01\x01\x00\x00\x00\x16", false, nil},
+		{"response", "\x84\x00\x00\x00\x06\x00\x00\x00\x30", false, nil},
+		{"query opcode", "\x04\x00\x00\x01\x07\x00\x00\x00\x16", false, nil},
+		{"body too large", "\x04\x00\x00\x01\x01\x00\x02\x00\x00", false, nil},
+		{"compressed", "\x04\x01\x00\x01\x01\x00\x00\x00\x16", false, nil},
+		{"socks5 greeting", "\x05\x01\x00", false, nil},
+		{"socks4 connect", "\x04\x01\x00\x50\x7f\x00\x00\x01\x00", false, nil},
+		{"short", "\x04\x00\x00\x00", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestCQLWithSOCKS(t *testing.T) {
+	route := router(t, "cql", "socks5", "socks4", "http")
+
+	tests := []struct {
+		name, data, want string
+	}{
+		{"cql v4", "\x04\x00\x00\x00\x05\x00\x00\x00\x00", "cql"},
+		{"cql v5", "\x05\x00\x00\x00\x05\x00\x00\x00\x00", "cql"},
+		// the short greetings are decided on the second byte, without waiting for a CQL frame header
+		{"socks5 greeting", "\x05\x01\x00", "socks5"},
+		{"socks5 two methods", "\x05\x02\x00\x02", "socks5"},
+		{"socks4 connect", "\x04\x01\x00\x50\x7f\x00\x00\x01\x00", "socks4"},
+		{"http", "GET / HTTP/1.1\r\n\r\n", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := route(t, tt.data); got != tt.want {
+				t.Fatalf("delivered to %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRDP(t *testing.T) {
+	runDetectTests(t, munproto.IsRDP, []detectTest{
+		// mstsc: TPKT of 43 bytes, X.224 CR with a routing cookie and a RDP negotiation request
+		{"mstsc", "\x03\x00\x00\x2b\x26\xe0\x00\x00\x00\x00\x00Cookie: mstshash=user\r\n\x01\x00\x08\x00\x03\x00\x00\x00", true, nil},
+		// the minimal request of scanners, without cookie and negotiation
+		{"minimal", "\x03\x00\x00\x0b\x06\xe0\x00\x00\x00\x00\x00", true, nil},
+		{"connection confirm", "\x03\x00\x00\x13\x0e\xd0\x00\x00\x12\x34\x00", false, nil},
+		{"length mismatch", "\x03\x00\x00\x2b\x20\xe0\x00\x00\x00\x00\x00", false, nil},
+		{"reserved set", "\x03\x01\x00\x2b\x26\xe0\x00", false, nil},
+		// RTMP C0 and the start of C1: version 3, a 4 byte timestamp and 4 zero bytes
+		{"rtmp zero time", "\x03\x00\x00\x00\x00\x00\x00\x00\x00\x5f\x1a\xc3", false, nil},
+		{"rtmp flash player", "\x03\x00\x0f\x42\x40\x80\x00\x07\x02\x5f\x1a\xc3", false, nil},
+		{"rtmp obs", "\x03\x00\x00\x44\x27\x00\x00\x00\x00\x9e\x3b\x01", false, nil},
+		{"tls", "\x16\x03\x01\x00\xa5\x01\x00\x00\xa1", false, nil},
+		{"short", "\x03\x00\x00\x2b", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestRDPWithRTMP(t *testing.T) {
+	// RTMP has no built-in detector, a server accepting it next to RDP matches the version byte
+	rtmp := munproto.MustSignature("03")
+	c1 := strings.Repeat("\x00", 8) + strings.Repeat("\x5a", 1528)
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddProto("rdp", munproto.IsRDP)
+	d.AddProto("rtmp", rtmp)
+	rdp := d.Listener("rdp")
+	rtmpl := d.Listener("rtmp")
+	go d.Listen()
+	defer d.Close()
+
+	tests := []struct {
+		name, data string
+		want       net.Listener
+	}{
+		{"rdp", "\x03\x00\x00\x0b\x06\xe0\x00\x00\x00\x00\x00", rdp},
+		{"rtmp", "\x03" + c1, rtmpl},
+		{"rtmp timestamp", "\x03\x00\x00\x44\x27" + c1[4:], rtmpl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := pl.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			go conn.Write([]byte(tt.data))
+			acceptWithin(t, tt.want, time.Second).Close()
+		})
+	}
+}
+
+func TestIsTelnet(t *testing.T) {
+	// inetutils telnet: DO SUPPRESS-GO-AHEAD, WILL TERMINAL-TYPE, WILL NAWS, WILL TSPEED
+	client := "\xff\xfd\x03\xff\xfb\x18\xff\xfb\x1f\xff\xfb\x20"
+
+	runDetectTests(t, munproto.IsTelnet, []detectTest{
+		{"inetutils", client, true, nil},
+		{"will", "\xff\xfb\x18", true, nil},
+		{"wont", "\xff\xfc\x01", true, nil},
+		{"dont", "\xff\xfe\x01", true, nil},
+		// SB and other commands don't start a negotiation
+		{"subnegotiation", "\xff\xfa\x18\x00", false, nil},
+		{"nop", "\xff\xf1\x00", false, nil},
+		{"plain text", "login: admin\r\n", false, nil},
+		// ZMTP starts with 0xFF too
+		{"zmtp", "\xff\x00\x00\x00\x00\x00\x00\x00\x01\x7f\x03\x01", false, nil},
+		{"partial", "\xff\xfd", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.Telnet(true), []detectTest{
+		{"inetutils", client, true, nil},
+		{"single", "\xff\xfb\x18login", false, nil},
+		{"partial", "\xff\xfb\x18\xff", false, io.EOF},
+	})
+}
+
+func TestIsGit(t *testing.T) {
+	runDetectTests(t, munproto.IsGit, []detectTest{
+		// git clone git://example.com/project.git
+		{"upload-pack", "0032git-upload-pack /project.git\x00host=example.com\x00", true, nil},
+		{"receive-pack", "0033git-receive-pack /project.git\x00host=example.com\x00", true, nil},
+		{"upload-archive", "0024git-upload-archive /project.git\x00", true, nil},
+		// the length is exactly the command and the space
+		{"minimal", "0014git-upload-pack ", true, nil},
+		{"unknown command", "0030git-fetch-pack /project.git\x00host=example.com\x00", false, nil},
+		{"length shorter than command", "0010git-upload-pack /project.git\x00", false, nil},
+		{"upper case length", "003Agit-upload-pack /project.git\x00", false, nil},
+		{"flush", "0000", false, io.EOF},
+		{"http", "GET /project.git/info/refs HTTP/1.1\r\n", false, nil},
+		{"partial length", "003", false, io.EOF},
+		{"partial command", "0032git-uplo", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestIsRsync(t *testing.T) {
+	runDetectTests(t, munproto.IsRsync, []detectTest{
+		// rsync 3.2.7 client: the greeting with the checksum list, then the module name
+		{"rsync 3.2", "@RSYNCD: 31.0 sha512 sha256 sha1 md5 md4\nbackup\n", true, nil},
+		// rsync 3.1
+		{"rsync 3.1", "@RSYNCD: 31.0\n", true, nil},
+		{"rsync 3.0", "@RSYNCD: 30.0\n", true, nil},
+		{"greeting only", "@RSYNCD: ", true, nil},
+		{"lower case", "@rsyncd: 31.0\n", false, nil},
+		{"no space", "@RSYNCD:31.0\n", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial", "@RSYNC", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestIsSyslog(t *testing.T) {
+	runDetectTests(t, munproto.IsSyslog, []detectTest{
+		// rsyslog omfwd with TCP_Framing="octet-counted" and RFC 5424 messages
+		{"octet counting", "81 <34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed\n", true, nil},
+		// rsyslog and syslog-ng with the traditional LF framing and RFC 3164 messages
+		{"non-transparent", "<13>Oct 11 22:14:15 mymachine app: started\n", true, nil},
+		{"kernel emergency", "<0>1 - - - - - -\n", true, nil},
+		{"maximum pri", "<191>1 - - - - - -\n", true, nil},
+		{"empty pri", "<>1 - - - - - -\n", false, nil},
+		{"long pri", "<1234>1 - - - - - -\n", false, nil},
+		{"pri not numeric", "<a>1\n", false, nil},
+		{"xml", "<?xml version=\"1.0\"?>", false, nil},
+		{"html", "<html>", false, nil},
+		{"leading zero count", "081 <34>1", false, nil},
+		{"count without space", "81<34>1", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial pri", "<13", false, io.EOF},
+		{"partial count", "81 ", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestIsGraphite(t *testing.T) {
+	runDetectTests(t, munproto.IsGraphite, []detectTest{
+		// carbon-relay forwarding its own metrics
+		{"carbon relay", "carbon.relays.relay-a.metricsReceived 1834 1700000060\ncarbon.relays.relay-a.cpuUsage 0.0213 1700000060\n", true, nil},
+		{"float value", "servers.web01.load.avg1 0.75 1700000000\n", true, nil},
+		{"negative value", "temp.outside -3.5 1700000000\r\n", true, nil},
+		{"two fields", "servers.web01.load 0.75\n", false, nil},
+		{"four fields", "servers.web01.load 0.75 1700000000 extra\n", false, nil},
+		{"text value", "servers.web01.state up 1700000000\n", false, nil},
+		{"http get", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", false, nil},
+		{"http post", "POST /metrics HTTP/1.1\r\n", false, nil},
+		{"binary", "servers\x00web01 1 2\n", false, nil},
+		{"no line end", "servers.web01.load 0.75 " + strings.Repeat("1", 600), false, nil},
+		{"truncated", "servers.web01.load 0.75 17000", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.Graphite(16), []detectTest{
+		{"within limit", "a.b 1 170000000\n", true, nil},
+		{"over limit", "servers.web01.load 1 1700000000\n", false, nil},
+	})
+}
+
+func TestGraphiteWithHTTP(t *testing.T) {
+	route := router(t, "graphite", "http")
+
+	tests := []struct {
+		name, data, want string
+	}{
+		{"carbon relay", "carbon.relays.relay-a.metricsReceived 1834 1700000060\n", "graphite"},
+		{"http get", "GET /render?target=a.b HTTP/1.1\r\nHost: graphite\r\n\r\n", "http"},
+		{"http post", "POST /metrics/find HTTP/1.1\r\nContent-Length: 0\r\n\r\n", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := route(t, tt.data); got != tt.want {
+				t.Fatalf("delivered to %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLumberjack(t *testing.T) {
+	runDetectTests(t, munproto.IsLumberjack, []detectTest{
+		// filebeat: a window frame for 1000 events, then a compressed frame
+		{"window", "2W\x00\x00\x03\xe82C\x00\x00\x01\x2c", true, nil},
+		{"compressed", "2C\x00\x00\x01\x2c\x78\x9c", true, nil},
+		{"json", "2J\x00\x00\x00\x01\x00\x00\x00\x02{}", true, nil},
+		{"data", "2D\x00\x00\x00\x01", true, nil},
+		{"v1", "1D\x00\x00\x00\x01", false, nil},
+		{"unknown type", "2X", false, nil},
+		{"graphite", "servers.web01.load 0.75 1700000000\n", false, nil},
+		{"graphite numeric path", "2xx.count 5 1700000000\n", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"short", "2", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.Lumberjack(true), []detectTest{
+		{"v1 data", "1D\x00\x00\x00\x01", true, nil},
+		{"v1 window", "1W\x00\x00\x03\xe8", true, nil},
+		// v1 has no json frames
+		{"v1 json", "1J", false, nil},
+		{"v2 window", "2W\x00\x00\x03\xe8", true, nil},
+	})
+}
+
+func TestLumberjackWithText(t *testing.T) {
+	route := router(t, "lumberjack", "graphite", "http")
+
+	tests := []struct {
+		name, data, want string
+	}{
+		{"filebeat", "2W\x00\x00\x03\xe82C\x00\x00\x01\x2c", "lumberjack"},
+		{"graphite", "servers.web01.load 0.75 1700000000\n", "graphite"},
+		{"graphite numeric path", "2xx.count 5 1700000000\n", "graphite"},
+		{"http", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := route(t, tt.data); got != tt.want {
+				t.Fatalf("delivered to %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFluentForward(t *testing.T) {
+	// fluent-bit out_forward in forward mode: [tag, entries, {"size": 1, "chunk": ...}] with the entries as bin 32
+	fluentbit := "\x93\xa9cpu.local\xc6\x00\x00\x00\x1b\x92\xd7\x00\x65\x53\xf1\x00\x00\x00\x00\x00\x81\xa5cpu_p\xcb\x3f\xb9\x99\x99\x99\x99\x99\x9a" +
+		"\x82\xa4size\x01\xa5chunk\xb8p8n9gmxTQVC8/nh2wlKKeQ=="
+	// fluent-bit in message mode: [tag, time, record]
+	message := "\x93\xa9mem.local\xd7\x00\x65\x53\xf1\x00\x00\x00\x00\x00\x81\xa9Mem.total\xce\x00\x7a\x12\x00"
+
+	runDetectTests(t, munproto.IsFluentForward, []detectTest{
+		{"fluent-bit forward", fluentbit, true, nil},
+		{"fluent-bit message", message, true, nil},
+		{"long tag", "\x92\xd9\x29kubernetes.var.log.containers.nginx-7c5d8\x92", true, nil},
+		{"heartbeat", "\xc0", false, nil},
+		{"one element", "\x91\xa3tag", false, nil},
+		{"tag not a string", "\x93\xcf\x00\x00\x00\x00", false, nil},
+		{"map", "\x81\xa3tag\xa3cpu", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"short", "\x93", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.FluentForward(true), []detectTest{
+		{"heartbeat", "\xc0", true, nil},
+		{"fluent-bit forward", fluentbit, true, nil},
+	})
+}
+
+func TestIsZMTP(t *testing.T) {
+	runDetectTests(t, munproto.IsZMTP, []detectTest{
+		// libzmq 4.3: the signature, version 3.1 and the NULL mechanism
+		{"libzmq", "\xff\x00\x00\x00\x00\x00\x00\x00\x01\x7f\x03\x01NULL\x00", true, nil},
+		// the peer waits for the signature of the other side before it sends the version
+		{"signature only", "\xff\x00\x00\x00\x00\x00\x00\x00\x01\x7f", true, nil},
+		{"zero padding", "\xff\x00\x00\x00\x00\x00\x00\x00\x00\x7f", true, nil},
+		{"no 7f", "\xff\x00\x00\x00\x00\x00\x00\x00\x01\x01", false, nil},
+		{"padding", "\xff\x00\x00\x01\x00\x00\x00\x00\x01\x7f", false, nil},
+		{"telnet", "\xff\xfb\x18", false, nil},
+		{"bgp", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x00\x1d\x01", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial", "\xff\x00\x00\x00\x00\x00\x00\x00\x01", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestIsJSON(t *testing.T) {
+	// a JSON-RPC call of an Ethereum client
+	rpc := `{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` + "\n"
+
+	runDetectTests(t, munproto.IsJSON(64), []detectTest{
+		{"object", rpc, true, nil},
+		{"array", `[{"jsonrpc":"2.0","method":"eth_chainId","id":1}]`, true, nil},
+		{"leading whitespace", " \r\n\t{}", true, nil},
+		{"string", `"jsonrpc"`, false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"only whitespace", strings.Repeat(" ", 64) + "{}", false, nil},
+		{"partial whitespace", "  ", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.IsJSON(64, `"jsonrpc"`, `"method"`), []detectTest{
+		{"jsonrpc", rpc, true, nil},
+		{"method only", `{"method":"status"}`, true, nil},
+		{"other object", `{"user":"alice","password":"secret","remember":true}` + "\n", false, io.EOF},
+		{"key past limit", `{"params":["` + strings.Repeat("a", 64) + `"],"jsonrpc":"2.0"}`, false, nil},
+		{"partial key", `{"json`, false, io.EOF},
+		{"array", `[1, 2, 3]`, false, io.EOF},
+	})
+}
+
+func TestIsJSONInvalidLimit(t *testing.T) {
+	for _, maxPeek := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("IsJSON(%d) didn't panic", maxPeek)
+				}
+			}()
+			munproto.IsJSON(maxPeek)
+		}()
+	}
+}
+
+func TestIsIRC(t *testing.T) {
+	runDetectTests(t, munproto.IsIRC, []detectTest{
+		{"cap ls", "CAP LS 302\r\nNICK alice\r\nUSER alice 0 * :Alice\r\n", true, nil},
+		{"nick", "NICK alice\r\n", true, nil},
+		{"user", "USER alice 0 * :Alice\r\n", true, nil},
+		{"pass", "PASS secret\r\nNICK alice\r\n", true, nil},
+		{"lowercase", "nick alice\r\n", false, nil},
+		{"no space", "NICK\r\n", false, nil},
+		{"longer command", "NICKNAME alice\r\n", false, nil},
+		{"prefix of command", "NIC alice\r\n", false, nil},
+		// first lines of SMTP and FTP clients
+		{"smtp ehlo", "EHLO mail.example.com\r\n", false, nil},
+		{"smtp helo", "HELO mail.example.com\r\n", false, nil},
+		{"smtp mail", "MAIL FROM:<a@example.com>\r\n", false, nil},
+		{"ftp auth", "AUTH TLS\r\n", false, nil},
+		{"ftp feat", "FEAT\r\n", false, nil},
+		// indistinguishable, but FTP clients only send it after the greeting of the server
+		{"ftp user", "USER anonymous\r\n", true, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial", "NIC", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestIsModbus(t *testing.T) {
+	// mbpoll: read 10 holding registers of unit 1, then write a single coil of unit 17
+	read := "\x00\x01\x00\x00\x00\x06\x01\x03\x00\x00\x00\x0a"
+	write := "\x00\x02\x00\x00\x00\x06\x11\x05\x00\xac\xff\x00"
+	// a user defined function code
+	custom := "\x00\x03\x00\x00\x00\x02\x01\x41"
+
+	runDetectTests(t, munproto.IsModbus, []detectTest{
+		{"read holding registers", read, true, nil},
+		{"write single coil", write, true, nil},
+		{"user defined function", custom, true, nil},
+		{"protocol id", "\x00\x01\x00\x01\x00\x06\x01\x03", false, nil},
+		{"protocol id partial", "\x00\x01\x01", false, nil},
+		{"short length", "\x00\x01\x00\x00\x00\x01\x01\x03", false, nil},
+		{"long length", "\x00\x01\x00\x00\x01\x2c\x01\x03", false, nil},
+		{"function zero", "\x00\x01\x00\x00\x00\x06\x01\x00", false, nil},
+		{"exception response", "\x00\x01\x00\x00\x00\x03\x01\x83\x02", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial", "\x00\x01\x00\x00\x00\x06\x01", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.Modbus(true), []detectTest{
+		{"read holding registers", read, true, nil},
+		{"encapsulated interface", "\x00\x01\x00\x00\x00\x05\x01\x2b\x0e\x01\x00", true, nil},
+		{"user defined function", custom, false, nil},
+	})
+}
+
+func TestIsBGP(t *testing.T) {
+	marker := strings.Repeat("\xff", 16)
+	// BIRD 2: OPEN of AS 65001 with the hold time 240, the router id 192.0.2.1 and no optional parameters
+	open := marker + "\x00\x1d\x01\x04\xfd\xe9\x00\xf0\xc0\x00\x02\x01\x00"
+
+	runDetectTests(t, munproto.IsBGP, []detectTest{
+		{"open", open, true, nil},
+		{"open with capabilities", marker + "\x00\x35\x01\x04\xfd\xe9\x00\xf0\xc0\x00\x02\x01\x18", true, nil},
+		{"keepalive", marker + "\x00\x13\x04", false, nil},
+		{"short length", marker + "\x00\x1c\x01", false, nil},
+		{"long length", marker + "\x10\x01\x01", false, nil},
+		// rejected at the first byte which isn't 0xFF
+		{"bad marker", "\xff\xff\xff\x00", false, nil},
+		{"telnet", "\xff\xfb\x18", false, nil},
+		{"zmtp", "\xff\x00\x00\x00\x00\x00\x00\x00\x01\x7f", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial marker", "\xff\xff\xff\xff", false, io.EOF},
+		{"partial header", marker + "\x00\x1d", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestIsSMPP(t *testing.T) {
+	// bind_transceiver of an SMPP 3.4 ESME with system id "smppclient1", password "password" and no address range
+	bind := "\x00\x00\x00\x2a\x00\x00\x00\x09\x00\x00\x00\x00\x00\x00\x00\x01" +
+		"smppclient1\x00password\x00\x00\x34\x00\x00\x00"
+	enquire := "\x00\x00\x00\x10\x00\x00\x00\x15\x00\x00\x00\x00\x00\x00\x00\x01"
+
+	runDetectTests(t, munproto.IsSMPP, []detectTest{
+		{"bind transceiver", bind, true, nil},
+		{"bind transmitter", "\x00\x00\x00\x2f\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x01", true, nil},
+		{"bind receiver", "\x00\x00\x00\x2f\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x01", true, nil},
+		{"enquire link", enquire, false, nil},
+		{"bind response", "\x00\x00\x00\x1c\x80\x00\x00\x09\x00\x00\x00\x00\x00\x00\x00\x01", false, nil},
+		{"status", "\x00\x00\x00\x2f\x00\x00\x00\x09\x00\x00\x00\x0d\x00\x00\x00\x01", false, nil},
+		{"short length", "\x00\x00\x00\x0f\x00\x00\x00\x09\x00\x00\x00\x00\x00\x00\x00\x01", false, nil},
+		{"long length", "\x00\x00\x02\x01\x00\x00\x00\x09\x00\x00\x00\x00\x00\x00\x00\x01", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial", "\x00\x00\x00\x2f\x00\x00\x00\x09", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.SMPP(munproto.SMPPEnquireLink), []detectTest{
+		{"enquire link", enquire, true, nil},
+		{"bind transceiver", bind, false, nil},
+	})
+}
+
+func TestIsClickHouse(t *testing.T) {
+	// clickhouse-client 24.8: Hello with the client name, version 24.8, revision 54471, database, user and password
+	client := "\x00\x11ClickHouse client\x18\x08\xc7\xa9\x03\x07default\x07default\x00"
+	// clickhouse-go reports its own name
+	golang := "\x00\x14clickhouse-go/2.28.0\x02\x1c\xc7\xa9\x03\x07default\x07default\x00"
+
+	runDetectTests(t, munproto.IsClickHouse, []detectTest{
+		{"clickhouse-client", client, true, nil},
+		{"clickhouse-go", golang, false, nil},
+		{"short name", "\x00\x05Click", false, nil},
+		{"empty name", "\x00\x00", false, nil},
+		{"long name", "\x00\x80\x01ClickHouse", false, nil},
+		{"packet id", "\x01\x11ClickHouse client", false, nil},
+		{"smpp", "\x00\x00\x00\x10\x00\x00\x00\x15", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial name", "\x00\x11Click", false, io.EOF},
+		{"partial", "\x00", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+
+	runDetectTests(t, munproto.ClickHouse(true), []detectTest{
+		{"clickhouse-client", client, true, nil},
+		{"clickhouse-go", golang, true, nil},
+		{"not printable", "\x00\x04\x01\x02\x03\x04", false, nil},
+		{"partial name", "\x00\x14clickhouse", false, io.EOF},
+	})
+}
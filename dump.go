@@ -0,0 +1,139 @@
+package munproto
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the default limit of dumps per minute, see WithDumpRateLimit
+const defaultDumpsPerMinute = 100
+
+// WithUnmatchedDump writes the first maxBytes peeked bytes of every unmatched or failed conn to w, hex dumped along
+// with the remote address and the time. Writes are asynchronous and rate limited, dumps which don't fit are dropped
+// and counted in Stats.DumpsDropped. Only applies when passed to New.
+func WithUnmatchedDump(w io.Writer, maxBytes int) Option {
+	return func(o *options) {
+		o.dumpWriter = w
+		o.dumpMaxBytes = maxBytes
+	}
+}
+
+// WithDumpRateLimit sets the maximum number of dumps written by WithUnmatchedDump per minute, 100 by default.
+func WithDumpRateLimit(perMinute int) Option {
+	return func(o *options) {
+		o.dumpsPerMinute = perMinute
+	}
+}
+
+// windowLimiter allows up to limit events per window.
+type windowLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	period time.Duration
+	start  time.Time
+	count  int
+	denied int
+}
+
+func newWindowLimiter(limit int, period time.Duration) *windowLimiter {
+	return &windowLimiter{limit: limit, period: period}
+}
+
+func (self *windowLimiter) allow() bool {
+	ok, _ := self.allowCount()
+	return ok
+}
+
+// same as allow, if the event is allowed also returns the number of events denied since the last allowed one.
+func (self *windowLimiter) allowCount() (bool, int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(self.start) >= self.period {
+		self.start = now
+		self.count = 0
+	}
+	if self.count >= self.limit {
+		self.denied++
+		return false, 0
+	}
+	self.count++
+
+	denied := self.denied
+	self.denied = 0
+	return true, denied
+}
+
+type dump struct {
+	time   time.Time
+	connID uint64
+	addr   net.Addr
+	reason error
+	data   []byte
+}
+
+type dumper struct {
+	w        io.Writer
+	maxBytes int
+	limiter  *windowLimiter
+	ch       chan dump
+}
+
+func newDumper(o *options, done <-chan struct{}) *dumper {
+	perMinute := o.dumpsPerMinute
+	if perMinute <= 0 {
+		perMinute = defaultDumpsPerMinute
+	}
+
+	d := &dumper{
+		w:        o.dumpWriter,
+		maxBytes: o.dumpMaxBytes,
+		limiter:  newWindowLimiter(perMinute, time.Minute),
+		ch:       make(chan dump, 16),
+	}
+	go d.run(done)
+	return d
+}
+
+func (self *dumper) run(done <-chan struct{}) {
+	for {
+		select {
+		case d := <-self.ch:
+			fmt.Fprintf(self.w, "%s #%d %v: %v\n%s", d.time.Format(time.RFC3339Nano), d.connID, d.addr, d.reason, hex.Dump(d.data))
+		case <-done:
+			return
+		}
+	}
+}
+
+// queue a dump of the bytes peeked from conn, returns false if it was dropped.
+func (self *dumper) dump(bufconn *bufConn, reason error) bool {
+	if !self.limiter.allow() {
+		return false
+	}
+
+	n := bufconn.r.Buffered()
+	if n > self.maxBytes {
+		n = self.maxBytes
+	}
+	data, _ := bufconn.r.Peek(n)
+
+	select {
+	case self.ch <- dump{time.Now(), bufconn.id, bufconn.RemoteAddr(), reason, append([]byte{}, data...)}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *Dispatcher) dumpConn(bufconn *bufConn, reason error) {
+	if self.dumper != nil && !self.dumper.dump(bufconn, reason) {
+		atomic.AddInt64(&self.counters.DumpsDropped, 1)
+	}
+}
@@ -0,0 +1,131 @@
+package munproto_test
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// chanWriter passes every write to a channel, so the test can wait for them
+type chanWriter chan string
+
+func (self chanWriter) Write(b []byte) (int, error) {
+	self <- string(b)
+	return len(b), nil
+}
+
+// blockedWriter blocks every write until the channel is closed
+type blockedWriter chan struct{}
+
+func (self blockedWriter) Write(b []byte) (int, error) {
+	<-self
+	return len(b), nil
+}
+
+// create a dispatcher with the proto http, the returned func sends data over a new conn and waits for the dispatch
+func dumpDispatcher(t *testing.T, opts ...munproto.Option) (*munproto.Dispatcher, func(data string)) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second, opts...)
+	d.AddProto("http", munproto.IsHTTP)
+	http := d.Listener("http")
+	closeAccepted(http)
+	var dispatched int64
+	d.AccessLog = func(rec munproto.DispatchRecord) {
+		atomic.AddInt64(&dispatched, 1)
+	}
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+
+	var sent int64
+	return d, func(data string) {
+		conn, err := pl.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go conn.Write([]byte(data))
+		sent++
+
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt64(&dispatched) < sent {
+			if time.Now().After(deadline) {
+				t.Fatal("conn not dispatched")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func nextDump(t *testing.T, w chanWriter) string {
+	t.Helper()
+	select {
+	case s := <-w:
+		return s
+	case <-time.After(time.Second):
+		t.Fatal("no dump written")
+		return ""
+	}
+}
+
+func TestUnmatchedDump(t *testing.T) {
+	w := make(chanWriter, 16)
+	_, send := dumpDispatcher(t, munproto.WithUnmatchedDump(w, 8))
+
+	send("GET / HTTP/1.1\r\n\r\n")
+	send("\xde\xad\xbe\xef not a known proto\r\n")
+
+	// only the unmatched conn is dumped, with the reason and no more than 8 bytes
+	s := nextDump(t, w)
+	if !strings.Contains(s, munproto.ErrNoMatch.Error()) || !strings.Contains(s, " pipe: ") {
+		t.Fatalf("dump %q, want the remote address and ErrNoMatch", s)
+	}
+	if !strings.HasSuffix(s, "\n"+hex.Dump([]byte("\xde\xad\xbe\xef not"))) {
+		t.Fatalf("dump %q, want the first 8 bytes", s)
+	}
+	select {
+	case s := <-w:
+		t.Fatalf("unexpected dump %q", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUnmatchedDumpRateLimit(t *testing.T) {
+	w := make(chanWriter, 16)
+	d, send := dumpDispatcher(t, munproto.WithUnmatchedDump(w, 8), munproto.WithDumpRateLimit(2))
+
+	for i := 0; i < 5; i++ {
+		send("\xde\xad\xbe\xef not a known proto\r\n")
+	}
+	nextDump(t, w)
+	nextDump(t, w)
+	select {
+	case s := <-w:
+		t.Fatalf("dump %q over the rate limit", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := d.Stats().DumpsDropped; n != 3 {
+		t.Fatalf("DumpsDropped = %d, want 3", n)
+	}
+}
+
+func TestUnmatchedDumpSlowWriter(t *testing.T) {
+	const conns = 32
+
+	w := make(blockedWriter)
+	defer close(w)
+	d, send := dumpDispatcher(t, munproto.WithUnmatchedDump(w, 8))
+
+	// the writer never returns, dispatch goes on and the dumps which don't fit the queue are dropped
+	for i := 0; i < conns; i++ {
+		send("\xde\xad\xbe\xef not a known proto\r\n")
+	}
+	if stats := d.Stats(); stats.Unmatched != conns || stats.DumpsDropped == 0 || stats.DumpsDropped >= conns {
+		t.Fatalf("Unmatched = %d, DumpsDropped = %d", stats.Unmatched, stats.DumpsDropped)
+	}
+}
@@ -0,0 +1,206 @@
+package munproto_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// start a dispatcher for http on a pipe listener, reporting errors passed to ErrorHandler on the returned chan
+func errorDispatcher(t *testing.T, timeout time.Duration) (*munproto.Dispatcher, *munprototest.PipeListener, chan error) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, timeout)
+	d.AddProto("http", munproto.IsHTTP)
+	d.Listener("http")
+
+	errs := make(chan error, 16)
+	d.ErrorHandler = func(err error) {
+		errs <- err
+	}
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, pl, errs
+}
+
+func TestErrNoMatch(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.Listener("http")
+
+	recs := make(chan munproto.DispatchRecord, 1)
+	d.AccessLog = func(rec munproto.DispatchRecord) {
+		recs <- rec
+	}
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("\xde\xad\xbe\xef not a known proto\r\n"))
+
+	select {
+	case rec := <-recs:
+		if !errors.Is(rec.Err, munproto.ErrNoMatch) {
+			t.Fatalf("DispatchRecord.Err = %v, want ErrNoMatch", rec.Err)
+		}
+		if rec.Proto != munproto.UnmatchedProto {
+			t.Fatalf("DispatchRecord.Proto = %q, want %q", rec.Proto, munproto.UnmatchedProto)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("unmatched conn wasn't logged")
+	}
+}
+
+func TestErrDetectTimeout(t *testing.T) {
+	_, pl, errs := errorDispatcher(t, 50*time.Millisecond)
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GE"))
+
+	err = nextError(t, errs)
+	var derr *munproto.DetectionError
+	if !errors.As(err, &derr) {
+		t.Fatalf("error = %T %v, want *DetectionError", err, err)
+	}
+	if derr.Proto != "http" || derr.ConnID == 0 {
+		t.Errorf("DetectionError = %+v", derr)
+	}
+	if !errors.Is(err, munproto.ErrDetectTimeout) {
+		t.Errorf("errors.Is(%v, ErrDetectTimeout) = false", err)
+	}
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("error doesn't unwrap to a timeout net.Error: %v", err)
+	}
+}
+
+func TestDetectionErrorReset(t *testing.T) {
+	_, pl, errs := errorDispatcher(t, time.Second)
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GE"))
+	conn.Close()
+
+	err = nextError(t, errs)
+	var derr *munproto.DetectionError
+	if !errors.As(err, &derr) {
+		t.Fatalf("error = %T %v, want *DetectionError", err, err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("errors.Is(%v, io.EOF) = false", err)
+	}
+	if errors.Is(err, munproto.ErrDetectTimeout) {
+		t.Errorf("client reset matches ErrDetectTimeout: %v", err)
+	}
+}
+
+func TestErrDispatcherClosed(t *testing.T) {
+	d := munproto.NewDefault(munprototest.NewPipeListener())
+	l := d.Listener("http")
+	go d.Listen()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	d.Close()
+
+	for _, err := range []error{<-accepted, acceptErr(d.Listener("https"))} {
+		if !errors.Is(err, munproto.ErrDispatcherClosed) {
+			t.Errorf("errors.Is(%v, ErrDispatcherClosed) = false", err)
+		}
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("errors.Is(%v, net.ErrClosed) = false", err)
+		}
+	}
+}
+
+func acceptErr(l net.Listener) error {
+	_, err := l.Accept()
+	return err
+}
+
+func TestDetectorPanic(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddProto("panic", func(r *bufio.Reader) (bool, error) {
+		data, err := r.Peek(1)
+		if err != nil {
+			return false, err
+		}
+		if data[0] == '!' {
+			var m map[string]int
+			m["boom"]++
+		}
+		return false, nil
+	})
+	d.AddProto("http", munproto.IsHTTP)
+	l := d.Listener("http")
+	d.Listener("panic")
+
+	errs := make(chan error, 16)
+	d.ErrorHandler = func(err error) {
+		errs <- err
+	}
+	go d.Listen()
+	defer d.Close()
+
+	const panics = 3
+	for i := 0; i < panics; i++ {
+		conn, err := pl.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go conn.Write([]byte("!boom, not http\r\n"))
+
+		err = nextError(t, errs)
+		var perr *munproto.PanicError
+		if !errors.As(err, &perr) {
+			t.Fatalf("error = %T %v, want *PanicError", err, err)
+		}
+		var derr *munproto.DetectionError
+		if !errors.As(err, &derr) || derr.Proto != "panic" {
+			t.Fatalf("error = %v, want a DetectionError of proto panic", err)
+		}
+		if len(perr.Stack) == 0 {
+			t.Error("PanicError.Stack is empty")
+		}
+	}
+
+	// the dispatcher keeps serving after the panics
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET /after HTTP/1.1\r\n\r\n"))
+	c := acceptWithin(t, l, time.Second)
+	defer c.Close()
+	if got := readRequestLine(t, c); got != "GET /after HTTP/1.1" {
+		t.Fatalf("request line = %q", got)
+	}
+
+	if n := d.Stats().Panics; n != panics {
+		t.Fatalf("Panics = %d, want %d", n, panics)
+	}
+}
@@ -0,0 +1,197 @@
+package munproto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrListenerExists is returned by Dispatcher.Forward for protos which already have a listener.
+var ErrListenerExists = errors.New("munproto: proto already has a listener")
+
+// ForwardError is reported to Dispatcher.ErrorHandler when relaying a conn to an upstream address fails.
+type ForwardError struct {
+	ConnID uint64
+	Addr   string
+	Err    error
+}
+
+func (self *ForwardError) Error() string {
+	return fmt.Sprintf("forward to %s: %v", self.Addr, self.Err)
+}
+
+func (self *ForwardError) Unwrap() error {
+	return self.Err
+}
+
+// WithDialTimeout sets the timeout for dialing the upstream address of forwarded conns.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithProxyHeader sends a PROXY protocol v2 header with the addresses of the client to the upstream of forwarded
+// conns.
+func WithProxyHeader() Option {
+	return func(o *options) {
+		o.proxyHeader = true
+	}
+}
+
+type forwarder struct {
+	addr string
+	options
+}
+
+func newForwarder(addr string, opts []Option) *forwarder {
+	f := &forwarder{addr: addr}
+	for _, opt := range opts {
+		opt(&f.options)
+	}
+	return f
+}
+
+// relay conns which no proto matched to addr instead of closing them. The peeked bytes are replayed to the upstream,
+// then data is copied in both directions until both sides are done. WithDialTimeout and WithIdleTimeout passed to the
+// dispatcher apply unless overridden by opts.
+func (self *Dispatcher) ForwardUnmatched(addr string, opts ...Option) {
+	f := newForwarder(addr, opts)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.unmatched = f
+}
+
+// relay conns matched to proto to addr, as an alternative to Listener when the consumer is another process. The
+// peeked bytes are replayed to the upstream, then data is copied in both directions until both sides are done. opts
+// override the dial and idle timeouts of the dispatcher.
+func (self *Dispatcher) Forward(proto, addr string, opts ...Option) error {
+	f := newForwarder(addr, opts)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, ok := self.protos[proto]; !ok {
+		return fmt.Errorf("munproto: undefined proto: %s", proto)
+	}
+	if _, ok := self.listeners[proto]; ok {
+		return ErrListenerExists
+	}
+
+	if _, ok := self.forwards[proto]; !ok {
+		self.addOrder(proto)
+	}
+	self.forwards[proto] = f
+	return nil
+}
+
+func (self *Dispatcher) forward(conn *bufConn, f *forwarder) {
+	dialTimeout, idleTimeout := f.dialTimeout, f.idleTimeout
+	if dialTimeout == 0 {
+		dialTimeout = self.dialTimeout
+	}
+	if idleTimeout == 0 {
+		idleTimeout = self.idleTimeout
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	upstream, err := dialer.Dial("tcp", f.addr)
+	if err != nil {
+		atomic.AddInt64(&self.counters.ForwardErrors, 1)
+		self.handleError(LogForwardErrors, &ForwardError{ConnID: conn.id, Addr: f.addr, Err: err})
+		conn.Close()
+		return
+	}
+	atomic.AddInt64(&self.counters.Forwarded, 1)
+
+	if f.proxyHeader {
+		h := &ProxyHeader{Source: conn.RemoteAddr(), Destination: conn.LocalAddr()}
+		if _, err := h.WriteTo(upstream); err != nil {
+			atomic.AddInt64(&self.counters.ForwardErrors, 1)
+			self.handleError(LogForwardErrors, &ForwardError{ConnID: conn.id, Addr: f.addr, Err: err})
+			conn.Close()
+			upstream.Close()
+			return
+		}
+	}
+
+	act := &activity{}
+	act.touch()
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- relay(upstream, conn, act, idleTimeout)
+	}()
+	go func() {
+		errCh <- relay(conn, upstream, act, idleTimeout)
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			atomic.AddInt64(&self.counters.ForwardErrors, 1)
+			self.handleError(LogForwardErrors, &ForwardError{ConnID: conn.id, Addr: f.addr, Err: err})
+			break
+		}
+	}
+
+	conn.Close()
+	upstream.Close()
+}
+
+// copy src to dst, when src is done the write side of dst is closed so the peer sees EOF.
+func relay(dst, src net.Conn, act *activity, idleTimeout time.Duration) error {
+	var err error
+	if idleTimeout > 0 {
+		_, err = io.Copy(dst, &idleReader{src, idleTimeout, act})
+	} else {
+		_, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// activity is the time of the last read in either direction of a forwarded conn.
+type activity struct {
+	last int64
+}
+
+func (self *activity) touch() {
+	atomic.StoreInt64(&self.last, time.Now().UnixNano())
+}
+
+func (self *activity) since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&self.last)))
+}
+
+// idleReader extends the read deadline of conn before every read. A read which times out while the other direction
+// was active within timeout is retried, so the relay only fails once both directions are idle.
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	act     *activity
+}
+
+func (self *idleReader) Read(b []byte) (int, error) {
+	for {
+		self.conn.SetReadDeadline(time.Now().Add(self.timeout - self.act.since()))
+		n, err := self.conn.Read(b)
+		if n > 0 {
+			self.act.touch()
+		}
+
+		var nerr net.Error
+		if n == 0 && errors.As(err, &nerr) && nerr.Timeout() && self.act.since() < self.timeout {
+			continue
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,146 @@
+package munproto_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+)
+
+// start a TCP server which runs handle for every conn, returns its address
+func startUpstream(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// start a dispatcher on a TCP listener, returns it and its address
+func startDispatcher(t *testing.T, opts ...munproto.Option) (*munproto.Dispatcher, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := munproto.NewDefault(l, opts...)
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, l.Addr().String()
+}
+
+func TestForwardIdleOneWay(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	const chunks = 10
+
+	upstream := startUpstream(t, func(conn net.Conn) {
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			return
+		}
+		// only the upstream sends, for much longer than the idle timeout
+		for i := 0; i < chunks; i++ {
+			time.Sleep(idle / 3)
+			if _, err := conn.Write([]byte("chunk\n")); err != nil {
+				return
+			}
+		}
+	})
+
+	d, addr := startDispatcher(t)
+	if err := d.Forward("http", upstream, munproto.WithIdleTimeout(idle)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendHTTP(t, conn, "/stream")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), "chunk\n"); got != chunks {
+		t.Fatalf("received %d chunks, want %d", got, chunks)
+	}
+}
+
+func TestForwardIdleBothWays(t *testing.T) {
+	tests := []struct {
+		name     string
+		global   []munproto.Option
+		forward  []munproto.Option
+		min, max time.Duration
+	}{
+		{
+			name:    "forward option",
+			forward: []munproto.Option{munproto.WithIdleTimeout(100 * time.Millisecond)},
+			min:     100 * time.Millisecond,
+			max:     time.Second,
+		},
+		{
+			name:   "dispatcher default",
+			global: []munproto.Option{munproto.WithIdleTimeout(100 * time.Millisecond)},
+			min:    100 * time.Millisecond,
+			max:    time.Second,
+		},
+		{
+			name:    "forward overrides dispatcher",
+			global:  []munproto.Option{munproto.WithIdleTimeout(50 * time.Millisecond)},
+			forward: []munproto.Option{munproto.WithIdleTimeout(400 * time.Millisecond)},
+			min:     400 * time.Millisecond,
+			max:     2 * time.Second,
+		},
+	}
+
+	upstream := startUpstream(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, addr := startDispatcher(t, tt.global...)
+			if err := d.Forward("http", upstream, tt.forward...); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			sendHTTP(t, conn, "/idle")
+
+			conn.SetReadDeadline(time.Now().Add(tt.max))
+			if _, err := io.ReadAll(conn); err != nil {
+				t.Fatalf("conn wasn't closed after the idle timeout: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.min {
+				t.Fatalf("conn closed after %v, before the idle timeout %v", elapsed, tt.min)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package munproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// the longest request line HTTPProxyRequest waits for
+const maxRequestLine = 4096
+
+// ErrHeadTooLarge is returned by PeekHTTPHead when the head doesn't fit into the limit.
+var ErrHeadTooLarge = errors.New("munproto: http head too large")
+
+// WithHeadGrace bounds the pause of a client which has sent part of its head: once bytes of the conn were received,
+// a detector waits at most d for more of them. When the grace timeout expires the detector gets a timeout error, e.g.
+// PeekHTTPHead returns the truncated head, and the conn falls through to the next proto, which usually decides on the
+// bytes already buffered, like the generic "http" proto. The detection timeout still bounds the wait for the first
+// bytes.
+func WithHeadGrace(d time.Duration) Option {
+	return func(o *options) {
+		o.headGrace = d
+	}
+}
+
+// peek the HTTP head (request line and headers, including the terminating empty line) without consuming it. Both
+// CRLF and bare LF line endings are accepted, for pipelined requests only the first head is returned.
+//
+// The peek grows incrementally, so it never waits for more bytes than the client has sent. If the head doesn't end
+// within max bytes ErrHeadTooLarge is returned, if the buffer of r is smaller than max and it doesn't end within the
+// buffer bufio.ErrBufferFull. If reading fails before the head is complete, e.g. the client paused mid-header and the
+// read deadline or the grace timeout of WithHeadGrace expired, the truncated head is returned along with the read
+// error.
+func PeekHTTPHead(r *bufio.Reader, max int) ([]byte, error) {
+	return peekUntil(r, max, headEnd)
+}
+
+// peek the first line, including the line ending, the same way PeekHTTPHead peeks the head.
+func peekLine(r *bufio.Reader, max int) ([]byte, error) {
+	return peekUntil(r, max, lineEnd)
+}
+
+// peek incrementally until end finds the end of the peeked data within max bytes, see PeekHTTPHead. end returns the
+// length of the data up to its end or -1, scanning from the length of the prefix already known not to contain it.
+func peekUntil(r *bufio.Reader, max int, end func(data []byte, from int) int) ([]byte, error) {
+	errFull := ErrHeadTooLarge
+	if max > r.Size() {
+		max = r.Size()
+		errFull = bufio.ErrBufferFull
+	}
+
+	scanned := 0
+	n := 1
+	for {
+		data, err := r.Peek(n)
+		if len(data) > max {
+			data = data[:max]
+		}
+
+		if i := end(data, scanned); i > 0 {
+			return data[:i], nil
+		}
+		scanned = len(data)
+
+		if len(data) >= max {
+			return data, errFull
+		}
+		if err != nil {
+			return data, err
+		}
+
+		n = r.Buffered()
+		if n <= len(data) {
+			n = len(data) + 1
+		}
+		if n > max {
+			n = max
+		}
+	}
+}
+
+// return the length of the head in data or -1, if the end of the head isn't in data yet. from is the length of the
+// prefix which is already known not to contain the end.
+func headEnd(data []byte, from int) int {
+	if from -= 2; from < 0 {
+		from = 0
+	}
+
+	for {
+		i := bytes.IndexByte(data[from:], '\n')
+		if i < 0 {
+			return -1
+		}
+		i += from
+
+		rest := data[i+1:]
+		if len(rest) > 0 && rest[0] == '\n' {
+			return i + 2
+		}
+		if len(rest) > 1 && rest[0] == '\r' && rest[1] == '\n' {
+			return i + 3
+		}
+		from = i + 1
+	}
+}
+
+// return the length of the first line in data, including the line ending, or -1 if data has no line ending yet.
+func lineEnd(data []byte, from int) int {
+	if i := bytes.IndexByte(data[from:], '\n'); i >= 0 {
+		return from + i + 1
+	}
+	return -1
+}
+
+// split the request line into method, target and version, ok is false if line isn't a request line.
+func parseRequestLine(line []byte) (method, target, version string, ok bool) {
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return "", "", "", false
+	}
+	return fields[0], fields[1], fields[2], true
+}
+
+// create a detector which matches requests to a forward proxy: CONNECT and requests with an absolute-form target
+// (e.g. "GET http://example.com/ HTTP/1.1"). Origin-form requests, including "OPTIONS *", don't match, so it must be
+// registered before the generic "http" proto.
+func HTTPProxyRequest() func(*bufio.Reader) (bool, error) {
+	return func(r *bufio.Reader) (bool, error) {
+		if ok, err := IsHTTP(r); !ok || err != nil {
+			return false, err
+		}
+
+		line, err := peekLine(r, maxRequestLine)
+		if err == ErrHeadTooLarge {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		method, target, _, ok := parseRequestLine(line)
+		if !ok {
+			return false, nil
+		}
+		if method == "CONNECT" {
+			return true, nil
+		}
+
+		target = strings.ToLower(target)
+		return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"), nil
+	}
+}
+
+// create a detector which matches HTTP requests for which pred returns true, it is called with the method and target
+// of the request line and the parsed headers. The whole head is peeked, so a conn isn't matched before its head is
+// complete, and heads which don't fit into max bytes or don't parse don't match. It must be registered before the
+// generic "http" proto.
+func HTTPHeader(max int, pred func(method, target string, h textproto.MIMEHeader) bool) func(*bufio.Reader) (bool, error) {
+	return func(r *bufio.Reader) (bool, error) {
+		if ok, err := IsHTTP(r); !ok || err != nil {
+			return false, err
+		}
+
+		head, err := PeekHTTPHead(r, max)
+		if err == ErrHeadTooLarge {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(head)))
+		line, err := tr.ReadLine()
+		if err != nil {
+			return false, nil
+		}
+		method, target, _, ok := parseRequestLine([]byte(line))
+		if !ok {
+			return false, nil
+		}
+
+		h, err := tr.ReadMIMEHeader()
+		if err != nil {
+			return false, nil
+		}
+		return pred(method, target, h), nil
+	}
+}
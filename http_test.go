@@ -0,0 +1,144 @@
+package munproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+func TestPeekHTTPHead(t *testing.T) {
+	head := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+	tests := []struct {
+		name    string
+		data    string
+		max     int
+		bufSize int
+		want    string
+		wantErr error
+	}{
+		{"crlf", head + "body", 1024, 4096, head, nil},
+		{"bare lf", "GET / HTTP/1.1\nHost: a\n\nbody", 1024, 4096, "GET / HTTP/1.1\nHost: a\n\n", nil},
+		{"mixed", "GET / HTTP/1.1\r\nHost: a\n\r\n", 1024, 4096, "GET / HTTP/1.1\r\nHost: a\n\r\n", nil},
+		{"pipelined", head + head, 1024, 4096, head, nil},
+		{"exactly at limit", head, len(head), 4096, head, nil},
+		{"over limit", head, len(head) - 1, 4096, head[:len(head)-1], munproto.ErrHeadTooLarge},
+		{"larger than buffer", head, 1024, 16, head[:16], bufio.ErrBufferFull},
+		{"truncated", "GET / HTTP/1.1\r\nHo", 1024, 4096, "GET / HTTP/1.1\r\nHo", io.EOF},
+		{"empty", "", 1024, 4096, "", io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(iotest.OneByteReader(bytes.NewReader([]byte(tt.data))), tt.bufSize)
+			got, err := munproto.PeekHTTPHead(r, tt.max)
+			if string(got) != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("PeekHTTPHead() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+			if r.Buffered() < len(got) {
+				t.Fatal("the head was consumed")
+			}
+		})
+	}
+}
+
+func TestHeadGrace(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, 5*time.Second)
+	d.AddProto("header", munproto.HTTPHeader(4096, func(method, target string, h textproto.MIMEHeader) bool {
+		return true
+	}), munproto.WithHeadGrace(50*time.Millisecond))
+	d.AddProto("http", munproto.IsHTTP)
+	header := d.Listener("header")
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	// a complete head matches the header proto
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	acceptWithin(t, header, time.Second).Close()
+
+	// the client pauses mid-header, the conn falls through to http after the grace timeout
+	conn, err = pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: exa"))
+
+	c := acceptWithin(t, http, time.Second)
+	defer c.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("delivered after %v, before the grace timeout", elapsed)
+	}
+
+	// the rest of the head arrives on the delivered conn, without the grace deadline
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte("mple.com\r\n\r\n"))
+	}()
+	tr := textproto.NewReader(bufio.NewReader(c))
+	if line, err := tr.ReadLine(); err != nil || line != "GET / HTTP/1.1" {
+		t.Fatalf("request line %q, %v", line, err)
+	}
+	head, err := tr.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host := head.Get("Host"); host != "example.com" {
+		t.Errorf("Host = %q", host)
+	}
+}
+
+func TestHTTPProxyRequest(t *testing.T) {
+	runDetectTests(t, munproto.HTTPProxyRequest(), []detectTest{
+		{"connect", "CONNECT example.com:443 HTTP/1.1\r\n\r\n", true, nil},
+		{"absolute http", "GET http://example.com/ HTTP/1.1\r\n", true, nil},
+		{"absolute https upper case", "GET HTTPS://example.com/ HTTP/1.0\n", true, nil},
+		{"origin form", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", false, nil},
+		{"options asterisk", "OPTIONS * HTTP/1.1\r\n", false, nil},
+		{"no version", "GET http://example.com/\r\n", false, nil},
+		{"line too long", "GET http://example.com/" + strings.Repeat("a", 5000) + " HTTP/1.1\r\n", false, nil},
+		{"truncated line", "GET http://example.com/ HTTP/1", false, io.EOF},
+		{"not http", "\x16\x03\x01\x00\xa5\x01\x00\x00\xa1\x03\x03", false, nil},
+	})
+}
+
+func TestHTTPHeader(t *testing.T) {
+	detect := munproto.HTTPHeader(256, func(method, target string, h textproto.MIMEHeader) bool {
+		return method == "POST" && target == "/rpc" && h.Get("X-Route") == "internal a b"
+	})
+
+	runDetectTests(t, detect, []detectTest{
+		{"match", "POST /rpc HTTP/1.1\r\nHost: a\r\nX-Route: internal a b\r\n\r\n", true, nil},
+		{"other value", "POST /rpc HTTP/1.1\r\nX-Route: external\r\n\r\n", false, nil},
+		{"other target", "POST / HTTP/1.1\r\nX-Route: internal a b\r\n\r\n", false, nil},
+		{"missing header", "POST /rpc HTTP/1.1\r\nHost: a\r\n\r\n", false, nil},
+		// obsolete line folding continues the value on the next line
+		{"folded", "POST /rpc HTTP/1.1\r\nX-Route: internal\r\n a\r\n\tb\r\nHost: a\r\n\r\n", true, nil},
+		// the chunked body isn't part of the head and isn't parsed as headers
+		{"chunked body", "POST /rpc HTTP/1.1\r\nTransfer-Encoding: chunked\r\nX-Route: internal a b\r\n\r\n" +
+			"5\r\nhello\r\nX-Route: x\r\n0\r\n\r\n", true, nil},
+		{"chunked-looking header", "POST /rpc HTTP/1.1\r\n5\r\nX-Route: internal a b\r\n\r\n", false, nil},
+		{"bare lf", "POST /rpc HTTP/1.1\nX-Route: internal a b\n\n", true, nil},
+		{"too large", "POST /rpc HTTP/1.1\r\nX-Pad: " + strings.Repeat("a", 256) + "\r\nX-Route: internal a b\r\n\r\n", false, nil},
+		{"bad request line", "POST /rpc\r\nX-Route: internal a b\r\n\r\n", false, nil},
+		{"truncated", "POST /rpc HTTP/1.1\r\nX-Route: internal a b\r\n", false, io.EOF},
+		{"not http", "\x16\x03\x01\x00\xa5\x01\x00\x00\xa1\x03\x03", false, nil},
+	})
+}
@@ -0,0 +1,48 @@
+package munproto
+
+import (
+	"context"
+	"net"
+	"runtime/pprof"
+)
+
+// the maximum length of the remote label
+const maxRemoteLabel = 64
+
+// WithProfilerLabels sets pprof labels on dispatch goroutines, so goroutine profiles show which phase (detect or
+// deliver), proto and peer they are at: phase, proto and remote with the host of the remote address. Only applies
+// when passed to New.
+func WithProfilerLabels() Option {
+	return func(o *options) {
+		o.profilerLabels = true
+	}
+}
+
+// run fn with the pprof labels returned by labels as key value pairs, if WithProfilerLabels is set. labels is only
+// called then, so dispatches without profiler labels don't pay for building them.
+func (self *Dispatcher) withLabels(fn func(), labels func() []string) {
+	if !self.profilerLabels {
+		fn()
+		return
+	}
+
+	pprof.Do(context.Background(), pprof.Labels(labels()...), func(context.Context) {
+		fn()
+	})
+}
+
+// return the host of addr for the remote label.
+func remoteLabel(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	if len(s) > maxRemoteLabel {
+		s = s[:maxRemoteLabel]
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+package munproto_test
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// return the labels sets of the goroutine profile
+func goroutineLabels(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var labels []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "# labels: ") {
+			labels = append(labels, strings.TrimPrefix(line, "# labels: "))
+		}
+	}
+	return strings.Join(labels, "\n")
+}
+
+// wait until the goroutine profile has labels containing all of want
+func waitLabels(t *testing.T, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		labels := goroutineLabels(t)
+		missing := false
+		for _, s := range want {
+			if !strings.Contains(labels, s) {
+				missing = true
+			}
+		}
+		if !missing {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("labels %q not in goroutine profile:\n%s", want, labels)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProfilerLabels(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl, munproto.WithProfilerLabels())
+	l := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	// stalled in detection, "GE" isn't enough for IsHTTP
+	stalled, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go stalled.Write([]byte("GE"))
+	waitLabels(t, `"phase":"detect"`, `"remote":"pipe"`)
+
+	// matched, but nobody accepts it yet
+	waiting, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiting.Close()
+	go waiting.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	waitLabels(t, `"phase":"deliver"`, `"proto":"http"`)
+
+	acceptWithin(t, l, time.Second).Close()
+}
+
+func TestProfilerLabelsDisabled(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GE"))
+	time.Sleep(20 * time.Millisecond)
+
+	if labels := goroutineLabels(t); strings.Contains(labels, `"phase"`) {
+		t.Fatalf("labels without WithProfilerLabels:\n%s", labels)
+	}
+}
@@ -0,0 +1,74 @@
+package munproto
+
+import (
+	"log"
+	"math/bits"
+	"time"
+)
+
+// LogCategory selects the errors logged by the logger of WithLogger.
+type LogCategory uint
+
+const (
+	// temporary accept errors (*AcceptError)
+	LogAcceptErrors LogCategory = 1 << iota
+	// detection errors, e.g. *DetectionError
+	LogDetectErrors
+	// TLS handshake and routing errors of TLSListener and WithPreDetectDeadline
+	LogTLSErrors
+	// dial and copy errors of forwarded conns (*ForwardError)
+	LogForwardErrors
+
+	numLogCategories = iota
+
+	LogAll = LogAcceptErrors | LogDetectErrors | LogTLSErrors | LogForwardErrors
+)
+
+// the default limit of logged errors per category and minute, see WithLogRateLimit
+const defaultLogsPerMinute = 60
+
+var logCategoryNames = [numLogCategories]string{"accept", "detect", "tls", "forward"}
+
+// WithLogger logs the errors of categories to l, at most 60 per category and minute by default, see
+// WithLogRateLimit. Unlike Dispatcher.Logger, which logs every error, errors of other categories cost nothing. Only
+// applies when passed to New.
+func WithLogger(l *log.Logger, categories LogCategory) Option {
+	return func(o *options) {
+		o.logger = l
+		o.logCategories = categories
+	}
+}
+
+// WithLogRateLimit sets the maximum number of errors per category logged by WithLogger per minute, errors over the
+// limit are dropped and their number is logged with the next logged error of the category.
+func WithLogRateLimit(perMinute int) Option {
+	return func(o *options) {
+		o.logsPerMinute = perMinute
+	}
+}
+
+func newLogLimiters(perMinute int) []*windowLimiter {
+	if perMinute <= 0 {
+		perMinute = defaultLogsPerMinute
+	}
+
+	limiters := make([]*windowLimiter, numLogCategories)
+	for i := range limiters {
+		limiters[i] = newWindowLimiter(perMinute, time.Minute)
+	}
+	return limiters
+}
+
+// log err of category to the logger of WithLogger, if the rate limit allows it.
+func (self *Dispatcher) logError(category LogCategory, err error) {
+	i := bits.TrailingZeros(uint(category))
+	ok, suppressed := self.logLimiters[i].allowCount()
+	if !ok {
+		return
+	}
+
+	if suppressed > 0 {
+		self.logger.Printf("munproto: %d %s errors suppressed", suppressed, logCategoryNames[i])
+	}
+	self.logger.Println("munproto: " + err.Error())
+}
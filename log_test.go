@@ -0,0 +1,130 @@
+package munproto
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of a log.Logger and reads of the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (self *syncBuffer) Write(b []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.Write(b)
+}
+
+func (self *syncBuffer) String() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.String()
+}
+
+// create dispatcher on a TCP listener which logs to the returned buffer
+func logDispatcher(t *testing.T, wrap func(net.Listener) net.Listener, categories LogCategory, opts ...Option) (*Dispatcher, net.Addr, *syncBuffer) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &syncBuffer{}
+	d := New(wrap(l), 50*time.Millisecond, append([]Option{WithLogger(log.New(buf, "", 0), categories)}, opts...)...)
+	d.AddProto("http", IsHTTP)
+	d.Listener("http")
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, l.Addr(), buf
+}
+
+// send data over a new conn and wait until the dispatcher closes it
+func sendAndWait(t *testing.T, addr net.Addr, data string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(data))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := conn.Read(make([]byte, 64)); err != nil {
+			return
+		}
+	}
+}
+
+// wait until d counted n detection errors
+func waitDetectErrors(t *testing.T, d *Dispatcher, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for d.Stats().DetectErrors < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d detection errors, want %d", d.Stats().DetectErrors, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoggerCategories(t *testing.T) {
+	plain := func(l net.Listener) net.Listener { return l }
+	tlsl := func(l net.Listener) net.Listener { return tls.NewListener(l, &tls.Config{}) }
+
+	tests := []struct {
+		name       string
+		wrap       func(net.Listener) net.Listener
+		categories LogCategory
+		data       string
+		want       string
+	}{
+		// "GE" times out in the http detector
+		{"detect logged", plain, LogDetectErrors, "GE", "i/o timeout"},
+		{"detect filtered", plain, LogTLSErrors | LogAcceptErrors | LogForwardErrors, "GE", ""},
+		// plaintext on a TLS listener fails the handshake of WithPreDetectDeadline
+		{"handshake logged", tlsl, LogTLSErrors, "GET / HTTP/1.1\r\n\r\n", "tls handshake error"},
+		{"handshake filtered", tlsl, LogDetectErrors | LogAcceptErrors | LogForwardErrors, "GET / HTTP/1.1\r\n\r\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, addr, buf := logDispatcher(t, tt.wrap, tt.categories, WithPreDetectDeadline(time.Second))
+
+			sendAndWait(t, addr, tt.data)
+			waitDetectErrors(t, d, 1)
+
+			got := buf.String()
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Fatalf("logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerSuppressed(t *testing.T) {
+	d, _, buf := logDispatcher(t, func(l net.Listener) net.Listener { return l }, LogDetectErrors)
+	for i := range d.logLimiters {
+		d.logLimiters[i] = newWindowLimiter(2, 50*time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		d.handleError(LogDetectErrors, errors.New("first window"))
+	}
+	// other categories have their own limits
+	d.handleError(LogTLSErrors, errors.New("filtered"))
+	time.Sleep(60 * time.Millisecond)
+	d.handleError(LogDetectErrors, errors.New("second window"))
+
+	want := "munproto: first window\nmunproto: first window\nmunproto: 3 detect errors suppressed\nmunproto: second window\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("logged\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package munproto
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// create a detector which matches conns starting with pattern, comparing only the bits set in mask:
+// data[i]&mask[i] == pattern[i]&mask[i]. Bytes are peeked incrementally, so a conn is rejected as soon as a byte
+// differs, without waiting for the whole pattern. Panics if pattern and mask have different lengths.
+func MaskedPrefix(pattern, mask []byte) func(*bufio.Reader) (bool, error) {
+	if len(pattern) != len(mask) || len(pattern) == 0 {
+		panic(fmt.Sprintf("munproto: invalid masked prefix: pattern of %d bytes, mask of %d bytes", len(pattern), len(mask)))
+	}
+
+	pattern = append([]byte{}, pattern...)
+	mask = append([]byte{}, mask...)
+
+	return func(r *bufio.Reader) (bool, error) {
+		checked := 0
+		n := 1
+		for {
+			data, err := r.Peek(n)
+			if len(data) > len(pattern) {
+				data = data[:len(pattern)]
+			}
+
+			for ; checked < len(data); checked++ {
+				if data[checked]&mask[checked] != pattern[checked]&mask[checked] {
+					return false, nil
+				}
+			}
+			if checked == len(pattern) {
+				return true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+
+			n = r.Buffered()
+			if n <= checked {
+				n = checked + 1
+			}
+			if n > len(pattern) {
+				n = len(pattern)
+			}
+		}
+	}
+}
+
+// create a MaskedPrefix detector from a signature of space separated hex bytes, where "??" matches any byte,
+// e.g. "16 03 ?? ?? ?? 01" for a TLS handshake record with a ClientHello.
+func Signature(sig string) (func(*bufio.Reader) (bool, error), error) {
+	var pattern, mask []byte
+	for _, field := range strings.Fields(sig) {
+		if field == "??" {
+			pattern = append(pattern, 0)
+			mask = append(mask, 0)
+			continue
+		}
+
+		b, err := hex.DecodeString(field)
+		if err != nil || len(b) != 1 {
+			return nil, fmt.Errorf("munproto: invalid signature byte %q", field)
+		}
+		pattern = append(pattern, b[0])
+		mask = append(mask, 0xff)
+	}
+
+	if len(pattern) == 0 {
+		return nil, fmt.Errorf("munproto: empty signature")
+	}
+	return MaskedPrefix(pattern, mask), nil
+}
+
+// same as Signature, but panics if sig is invalid.
+func MustSignature(sig string) func(*bufio.Reader) (bool, error) {
+	fn, err := Signature(sig)
+	if err != nil {
+		panic(err)
+	}
+	return fn
+}
+
+// create a detector which matches SOCKS5 greetings (05 NMETHODS METHODS...) offering any of methods, e.g. 0x02 for
+// username/password auth. Greetings without methods or truncated ones don't match, so it must be registered before
+// the generic "socks5" proto.
+func SOCKS5WithAuthMethod(methods ...byte) func(*bufio.Reader) (bool, error) {
+	methods = append([]byte{}, methods...)
+
+	return func(r *bufio.Reader) (bool, error) {
+		data, err := r.Peek(2)
+		if len(data) > 0 && data[0] != 0x05 {
+			return false, nil
+		}
+		if err != nil {
+			if len(data) > 0 {
+				return false, nil
+			}
+			return false, err
+		}
+
+		nmethods := int(data[1])
+		if nmethods == 0 {
+			return false, nil
+		}
+
+		// long method lists don't fit into the small detection buffer, bufio.ErrBufferFull makes the dispatcher grow it
+		data, err = r.Peek(2 + nmethods)
+		if err == bufio.ErrBufferFull {
+			return false, err
+		}
+		if err != nil {
+			return false, nil
+		}
+
+		for _, offered := range data[2:] {
+			for _, method := range methods {
+				if offered == method {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+}
@@ -0,0 +1,139 @@
+package munproto_test
+
+import (
+	"bufio"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+func TestMaskedPrefix(t *testing.T) {
+	// version 4 in the high nibble of the first byte, any header length, then 00
+	detect := munproto.MaskedPrefix([]byte{0x40, 0x00, 0x00}, []byte{0xf0, 0x00, 0xff})
+
+	runDetectTests(t, detect, []detectTest{
+		{"exact", "\x40\x00\x00", true, nil},
+		{"masked bits differ", "\x45\xaa\x00", true, nil},
+		{"longer than pattern", "\x4f\x01\x00\xde\xad", true, nil},
+		{"first byte differs", "\x60", false, nil},
+		{"last byte differs", "\x45\xaa\x01", false, nil},
+		{"partial match", "\x45\xaa", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestMaskedPrefixEarlyReject(t *testing.T) {
+	detect := munproto.MustSignature("16 03 ?? ?? ?? 01")
+
+	// a differing byte rejects the conn without waiting for the rest of the pattern
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("\x16\x04"))
+
+	done := make(chan bool, 1)
+	go func() {
+		ok, err := detect(bufio.NewReader(pr))
+		done <- ok || err != nil
+	}()
+
+	select {
+	case failed := <-done:
+		if failed {
+			t.Fatal("detect matched or failed, want false, nil")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("detect waited for the whole pattern")
+	}
+}
+
+func TestMaskedPrefixInvalid(t *testing.T) {
+	tests := []struct {
+		name          string
+		pattern, mask []byte
+	}{
+		{"mask too short", []byte{1, 2}, []byte{0xff}},
+		{"mask too long", []byte{1}, []byte{0xff, 0xff}},
+		{"empty", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("MaskedPrefix didn't panic")
+				}
+			}()
+			munproto.MaskedPrefix(tt.pattern, tt.mask)
+		})
+	}
+}
+
+func TestSignature(t *testing.T) {
+	detect, err := munproto.Signature("16 03 ?? ?? ?? 01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runDetectTests(t, detect, []detectTest{
+		{"tls 1.2 client hello", "\x16\x03\x01\x00\xa5\x01\x00\x00\xa1", true, nil},
+		{"tls server hello", "\x16\x03\x03\x00\x5a\x02", false, nil},
+		{"http", "GET / HTTP/1.1\r\n", false, nil},
+		{"partial", "\x16\x03\x01\x00", false, io.EOF},
+	})
+}
+
+func TestSignatureInvalid(t *testing.T) {
+	for _, sig := range []string{"", "  ", "16 0g", "160301", "1", "16 ?"} {
+		if _, err := munproto.Signature(sig); err == nil {
+			t.Errorf("Signature(%q) didn't fail", sig)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MustSignature didn't panic")
+		}
+	}()
+	munproto.MustSignature("zz")
+}
+
+func TestSOCKS5WithAuthMethod(t *testing.T) {
+	runDetectTests(t, munproto.SOCKS5WithAuthMethod(0x02), []detectTest{
+		{"offered", "\x05\x02\x00\x02", true, nil},
+		{"not offered", "\x05\x01\x00", false, nil},
+		{"no methods", "\x05\x00", false, nil},
+		{"socks4", "\x04\x01\x00\x50", false, nil},
+		{"truncated", "\x05\x03\x00\x01", false, nil},
+		{"truncated count", "\x05", false, nil},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+func TestSOCKS5WithAuthMethodGrow(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddProto("socks5 auth", munproto.SOCKS5WithAuthMethod(0x02))
+	d.AddProto("socks5", munproto.IsSOCKS5)
+	auth := d.Listener("socks5 auth")
+	d.Listener("socks5")
+	go d.Listen()
+	defer d.Close()
+
+	// the offered method is behind the end of the small detection buffer
+	greeting := []byte{0x05, 100}
+	for i := 0; i < 99; i++ {
+		greeting = append(greeting, 0x80)
+	}
+	greeting = append(greeting, 0x02)
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write(greeting)
+	acceptWithin(t, auth, time.Second).Close()
+}
@@ -1,24 +1,82 @@
 package munproto
 
 import (
-	"net"
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"sync"
+	"net"
+	"net/netip"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var defaultProtos = map[string]func(*bufio.Reader) (bool, error){
-	"socks5": IsSOCKS5,
-	"socks4": IsSOCKS4,
-	"https":  IsHTTPS,
-	"http":   IsHTTP,
+// evaluation order of the default protos, "http" goes last since it is the least strict
+var defaultOrder = []string{"socks5", "socks4", "https", "http"}
+
+// return the order in which the default protos are evaluated by NewDefault and DetectProto.
+func DefaultOrder() []string {
+	return append([]string{}, defaultOrder...)
 }
 
 var DefaultTimeout = 1 * time.Minute
 
+// ErrNoMatch is returned when none of the detectors recognized the connection.
+var ErrNoMatch = errors.New("munproto: no proto matched")
+
+// ErrDetectTimeout is matched by detection errors caused by the detection timeout, see DetectionError.
+var ErrDetectTimeout = errors.New("munproto: detection timeout")
+
+// ErrDispatcherClosed is returned by Accept of the listeners after the dispatcher is closed. It, and every other error
+// returned by Accept after shutdown, satisfies errors.Is(err, net.ErrClosed).
+var ErrDispatcherClosed = fmt.Errorf("munproto: dispatcher closed: %w", net.ErrClosed)
+
+// DetectionError is a failure of the detector of Proto, e.g. a client reset during detection. It matches
+// ErrDetectTimeout if Err is a timeout.
+type DetectionError struct {
+	ConnID uint64
+	Proto  string
+	Err    error
+}
+
+func (self *DetectionError) Error() string {
+	return fmt.Sprintf("detect %s: %v", self.Proto, self.Err)
+}
+
+func (self *DetectionError) Unwrap() error {
+	return self.Err
+}
+
+func (self *DetectionError) Is(target error) bool {
+	return target == ErrDetectTimeout && isTimeout(self.Err)
+}
+
+// PanicError is the DetectionError.Err of a detector which panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (self *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", self.Value, self.Stack)
+}
+
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// ErrEmptyConn is the DispatchRecord.Err of conns closed by the client before sending any bytes, like health checks
+// and port scans do. Such conns aren't reported to ErrorHandler.
+var ErrEmptyConn = errors.New("munproto: connection closed before sending any bytes")
+
 func IsSOCKS5(r *bufio.Reader) (bool, error) {
 	data, err := r.Peek(1)
 	if err != nil {
@@ -60,153 +118,1379 @@ func IsHTTP(r *bufio.Reader) (bool, error) {
 	return false, nil
 }
 
+// run the named detectors of BuiltinProtos (the default ones if protos is empty) in order and return the first
+// matching proto. The default order is socks5, socks4, https, http. Detectors only peek into r, so no bytes are
+// consumed.
+func DetectProto(r *bufio.Reader, protos ...string) (string, error) {
+	if len(protos) == 0 {
+		protos = defaultOrder
+	}
+
+	for _, proto := range protos {
+		info, ok := builtinProto(proto)
+		if !ok {
+			return "", fmt.Errorf("munproto: undefined proto: %s", proto)
+		}
+
+		ok, err := info.Detect(r)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return proto, nil
+		}
+	}
+
+	return "", ErrNoMatch
+}
+
+// detect the proto of conn with the default detectors. The returned conn replays the peeked bytes and must be used
+// instead of conn, it is returned even if detection failed. Deadlines are left to the caller.
+func SniffConn(conn net.Conn) (string, net.Conn, error) {
+	bufconn := newBufConn(conn)
+	proto, err := DetectProto(bufconn.r)
+	return proto, bufconn, err
+}
+
 type listener struct {
-	l      net.Listener
+	// counters of ListenerStats, accessed atomically
+	delivered  int64
+	accepted   int64
+	pending    int64
+	maxPending int64
+	// whether the high-water mark was exceeded since the queue was last empty
+	overflow int32
+
+	d      *Dispatcher
 	proto  string
 	connCh chan net.Conn
-	errCh  chan error
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
 }
 
 func (self *listener) Accept() (net.Conn, error) {
 	select {
 	case conn := <-self.connCh:
+		atomic.AddInt64(&self.accepted, 1)
 		return conn, nil
-	case err := <-self.errCh:
-		return nil, err
+	case <-self.done:
+		return nil, self.err
+	}
+}
+
+// ContextAcceptor is implemented by the listeners of Dispatcher and TLSListener.
+type ContextAcceptor interface {
+	// same as Accept, but returns ctx.Err() when ctx is done first. Conns are handed over synchronously, so a
+	// canceled call never takes a conn.
+	AcceptContext(ctx context.Context) (net.Conn, error)
+}
+
+func (self *listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-self.connCh:
+		atomic.AddInt64(&self.accepted, 1)
+		return conn, nil
+	case <-self.done:
+		return nil, self.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
 func (self *listener) Addr() net.Addr {
-	return self.l.Addr()
+	return self.d.baseListener().Addr()
 }
 
 func (self *listener) Close() error {
-	return self.l.Close()
+	return self.d.Close()
+}
+
+func (self *listener) isClosed() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
 }
 
-func newListener(l net.Listener, proto string) *listener {
+// close stops the listener, every pending and future Accept returns err.
+func (self *listener) close(err error) {
+	self.closeOnce.Do(func() {
+		self.err = err
+		close(self.done)
+	})
+}
+
+func newListener(d *Dispatcher, proto string) *listener {
 	return &listener{
-		l:      l,
+		d:      d,
 		proto:  proto,
 		connCh: make(chan net.Conn),
-		errCh:  make(chan error),
+		done:   make(chan struct{}),
+	}
+}
+
+// closedError wraps the terminal error of the base listener, so that it always satisfies errors.Is(err, net.ErrClosed)
+// and errors.Is(err, ErrDispatcherClosed).
+type closedError struct {
+	err error
+}
+
+func (self *closedError) Error() string {
+	return self.err.Error()
+}
+
+func (self *closedError) Unwrap() error {
+	return self.err
+}
+
+func (self *closedError) Is(target error) bool {
+	return target == net.ErrClosed || target == ErrDispatcherClosed
+}
+
+// options holds the settings which can be applied through Option.
+type options struct {
+	timeout     time.Duration
+	dialTimeout time.Duration
+	idleTimeout time.Duration
+	maxConnAge  time.Duration
+	preDetect   time.Duration
+	headGrace   time.Duration
+	readRate    int64
+	writeRate   int64
+	proxyHeader bool
+
+	dumpWriter     io.Writer
+	dumpMaxBytes   int
+	dumpsPerMinute int
+
+	tlsInfo  bool
+	snapshot int
+
+	highWater      int
+	rejectOverflow bool
+
+	profilerLabels bool
+
+	rejectDrain   int64
+	rejectTimeout time.Duration
+
+	logger        *log.Logger
+	logCategories LogCategory
+	logsPerMinute int
+
+	recentErrors int
+}
+
+// Option configures a proto registered with Dispatcher.AddProto or a forwarding. Options passed to New apply to every
+// proto, unless the proto sets its own value.
+type Option func(*options)
+
+// WithTimeout sets the read deadline used while the proto detector is running. It overrides (and may extend) the
+// dispatcher timeout for that detector only. If the detector times out the conn falls through to the next proto,
+// unless it was the last one.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithPreDetectDeadline bounds the time until the first byte of a conn is received, before any detector runs. If the
+// conn is a TLS conn (e.g. the base listener is created by tls.NewListener) it includes the handshake, and handshake
+// failures are reported as *TLSHandshakeError instead of detection errors. Only applies when passed to New.
+func WithPreDetectDeadline(d time.Duration) Option {
+	return func(o *options) {
+		o.preDetect = d
 	}
 }
 
+// WithIdleTimeout closes delivered conns when no bytes were read or written for the duration d. Forwarded conns
+// are closed when neither direction transferred bytes for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = d
+	}
+}
+
+// WithMaxConnAge closes delivered conns d after their delivery, regardless of activity. The handler
+// sees it as the usual error of a closed conn.
+func WithMaxConnAge(d time.Duration) Option {
+	return func(o *options) {
+		o.maxConnAge = d
+	}
+}
+
+type proto struct {
+	name     string
+	detectfn func(*bufio.Reader) (bool, error)
+	datafn   DataDetector
+	connfn   ConnDetector
+	info     ProtoInfo
+	options
+
+	readLimit  *bucket
+	writeLimit *bucket
+
+	policy     *Policy
+	tracer     *tracer
+	requireTLS bool
+
+	// shared by the copies of the proto, so they survive Trace and ReplaceProtos
+	counts *detectCounts
+}
+
+// detectCounts are the outcomes of the detector of a proto, accessed atomically.
+type detectCounts struct {
+	matched   int64
+	unmatched int64
+	errors    int64
+}
+
 type Dispatcher struct {
-	mu      sync.RWMutex
-	protos  map[string]func(*bufio.Reader) (bool, error)
-	timeout time.Duration
+	// the last assigned conn id, accessed atomically
+	connIDs uint64
+
+	mu     sync.RWMutex
+	protos map[string]*proto
+	options
 
 	listeners map[string]*listener
 	lorder    []string
+	order     []string
+	set       *protoSet
 	netl      net.Listener
+	forwards  map[string]*forwarder
+	unmatched *forwarder
+	rejecters map[string]RejectResponder
+	counters  *Stats
+	dumper    *dumper
+
+	logLimiters []*windowLimiter
+	recent      *errorRing
+
+	started  time.Time
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
 
 	Logger *log.Logger
+
+	// ProxyProtocol enables parsing of the PROXY protocol v2 header, which every conn then must start with. The
+	// header is consumed before detection, delivered conns report the addresses from it and its TLVs are available
+	// through ProxyTLVs.
+	ProxyProtocol bool
+
+	// ErrorHandler, if set, is called with every non fatal error, such as temporary accept errors (*AcceptError)
+	// and detection errors.
+	ErrorHandler func(err error)
+
+	// ObserveDetect, if set, is called with the wall time of every detector invocation, e.g. to feed a histogram.
+	// The total detection time of a conn is DispatchRecord.DetectDuration.
+	ObserveDetect func(proto string, d time.Duration)
+
+	// AccessLog, if set, is called exactly once for every dispatched conn, when it is known what happens to it.
+	AccessLog func(rec DispatchRecord)
+
+	// OnDenied, if set, is called when the policy of a proto denies a client, also if the conn then falls through to
+	// the later protos.
+	OnDenied func(proto string, addr net.Addr)
+
+	// OnHighWater, if set, is called when the number of conns of a proto waiting for Accept exceeds the mark set by
+	// WithHighWater. It is called again only after the queue drained.
+	OnHighWater func(proto string, pending int)
+
+	// OnConnClose, if set, is called exactly once when a conn delivered to a listener or forwarded is closed.
+	OnConnClose func(rec ConnCloseRecord)
+}
+
+// UnmatchedProto is the DispatchRecord.Proto of conns which no proto matched.
+const UnmatchedProto = "unmatched"
+
+// DispatchRecord describes the dispatch decision for a conn.
+type DispatchRecord struct {
+	// when the detection started
+	Time   time.Time
+	ConnID uint64
+	// the generation of the protos the conn was detected with, see DebugState.Generation
+	Generation uint64
+	RemoteAddr net.Addr
+	// matched proto, UnmatchedProto if none matched or detection failed
+	Proto string
+	// time from the start of the detection to the decision
+	DetectDuration time.Duration
+	// the number of bytes peeked during detection
+	Peeked int
+	// the server name sent in the ClientHello of TLS conns, only recorded with WithTLSInfo
+	ServerName string
+	// true if the conn matched but was rejected by a limit or a policy
+	Rejected bool
+	// the reason the conn wasn't delivered, nil if it was
+	Err error
 }
 
-func New(l net.Listener, timeout time.Duration) *Dispatcher {
-	return &Dispatcher{
-		protos:    make(map[string]func(*bufio.Reader) (bool, error)),
+// ConnCloseRecord describes a delivered or forwarded conn when it is closed, see Dispatcher.OnConnClose.
+type ConnCloseRecord struct {
+	Proto      string
+	ConnID     uint64
+	RemoteAddr net.Addr
+	// bytes read from and written to the conn, including the bytes buffered during detection
+	BytesRead    int64
+	BytesWritten int64
+	// time from the start of the detection to the close
+	Duration time.Duration
+	// the error returned by Close
+	Err error
+}
+
+// AcceptError is reported to Dispatcher.ErrorHandler when the base listener returns a temporary error. Listen waits
+// Delay before the next Accept.
+type AcceptError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (self *AcceptError) Error() string {
+	return fmt.Sprintf("accept error: %v; retrying in %v", self.Err, self.Delay)
+}
+
+func (self *AcceptError) Unwrap() error {
+	return self.Err
+}
+
+func New(l net.Listener, timeout time.Duration, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		protos:    make(map[string]*proto),
 		listeners: make(map[string]*listener),
+		forwards:  make(map[string]*forwarder),
+		rejecters: make(map[string]RejectResponder),
+		set:       &protoSet{},
 		netl:      l,
-		timeout:   timeout,
+		started:   time.Now(),
+		done:      make(chan struct{}),
+		counters:  &Stats{},
+	}
+
+	d.timeout = timeout
+	for _, opt := range opts {
+		opt(&d.options)
+	}
+
+	if d.dumpWriter != nil {
+		d.dumper = newDumper(&d.options, d.done)
+	}
+	if d.logger != nil {
+		d.logLimiters = newLogLimiters(d.logsPerMinute)
 	}
+	d.recent = newErrorRing(d.recentErrors)
+	return d
 }
 
-func NewDefault(l net.Listener) *Dispatcher {
-	d := New(l, DefaultTimeout)
-	for name, detectfn := range defaultProtos {
-		d.AddProto(name, detectfn)
+// create dispatcher with the default protos, which are evaluated in DefaultOrder regardless of the order of Listener
+// calls.
+func NewDefault(l net.Listener, opts ...Option) *Dispatcher {
+	d := New(l, DefaultTimeout, opts...)
+	for _, name := range defaultOrder {
+		info, _ := builtinProto(name)
+		d.AddProtoInfo(info)
 	}
+	d.SetOrder(defaultOrder...)
 	return d
 }
 
-func (self *Dispatcher) AddProto(name string, detectfn func(*bufio.Reader) (bool, error)) {
+func (self *Dispatcher) AddProto(name string, detectfn func(*bufio.Reader) (bool, error), opts ...Option) {
+	self.addProto(&proto{name: name, detectfn: detectfn}, opts)
+}
+
+// ConnDetector is a detector which also gets the dispatched conn, e.g. to decide on its addresses, which reflect the
+// PROXY header. It must read only through r, which buffers the bytes for the delivered conn.
+type ConnDetector func(conn net.Conn, r *bufio.Reader) (bool, error)
+
+// register a proto with a ConnDetector, same as AddProto otherwise.
+func (self *Dispatcher) AddConnProto(name string, fn ConnDetector, opts ...Option) {
+	self.addProto(&proto{name: name, connfn: fn}, opts)
+}
+
+func (self *Dispatcher) addProto(p *proto, opts []Option) {
+	self.initProto(p, opts)
+
 	self.mu.Lock()
 	defer self.mu.Unlock()
-	self.protos[name] = detectfn
+	self.protos[p.name] = p
+	self.rebuildSet()
+}
+
+// apply opts to p and create its rate limits and counters
+func (self *Dispatcher) initProto(p *proto, opts []Option) {
+	for _, opt := range opts {
+		opt(&p.options)
+	}
+	p.counts = &detectCounts{}
+
+	if p.readRate == 0 && p.writeRate == 0 {
+		p.readRate, p.writeRate = self.readRate, self.writeRate
+	}
+	p.readLimit = newBucket(p.readRate)
+	p.writeLimit = newBucket(p.writeRate)
 }
 
 // create listener for specific proto, which can use in http.Server.Serve(net.Listener) and etc..
-// if used RegisterProtoDefault, the sequence of calls is very important, because "http" proto used as default and therefore
-// other protocols should be called before "http"
+// the sequence of calls defines the order in which protos are evaluated, unless it is set by SetOrder (NewDefault
+// does it), so less strict protos like "http" should be called last
+// repeated calls for the same proto return the same listener, which can be shared by several consumers
 func (self *Dispatcher) Listener(proto string) net.Listener {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if l, ok := self.listeners[proto]; ok {
+		return l
+	}
+
 	if _, ok := self.protos[proto]; !ok {
 		panic(fmt.Sprintf("undefined proto: %s", proto))
 	}
+	if _, ok := self.forwards[proto]; ok {
+		panic(fmt.Sprintf("proto is forwarded: %s", proto))
+	}
 
-	self.lorder = append(self.lorder, proto)
+	self.addOrder(proto)
 
-	l := newListener(self.netl, proto)
+	l := newListener(self, proto)
 	self.listeners[proto] = l
+
+	select {
+	case <-self.done:
+		l.close(self.err)
+	default:
+	}
 	return l
 }
 
+// set the evaluation order of protos, it takes precedence over the order of Listener calls. Protos which aren't listed
+// are evaluated after the listed ones, in the order of Listener calls.
+func (self *Dispatcher) SetOrder(protos ...string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.order = append([]string{}, protos...)
+	self.sortOrder()
+}
+
+// add proto to the evaluation order, must be called with mu held
+func (self *Dispatcher) addOrder(proto string) {
+	self.lorder = append(self.lorder, proto)
+	self.sortOrder()
+}
+
+// must be called with mu held
+func (self *Dispatcher) sortOrder() {
+	rank := func(proto string) int {
+		for i, name := range self.order {
+			if name == proto {
+				return i
+			}
+		}
+		return len(self.order)
+	}
+
+	sort.SliceStable(self.lorder, func(i, j int) bool {
+		return rank(self.lorder[i]) < rank(self.lorder[j])
+	})
+	self.rebuildSet()
+}
+
+// protoSet is an immutable snapshot of the evaluated protos, every dispatch uses the one current when it starts.
+type protoSet struct {
+	// incremented with every change of the protos or their order
+	generation uint64
+	// in evaluation order
+	protos []*proto
+}
+
+// replace the snapshot of the protos after a change, must be called with mu held
+func (self *Dispatcher) rebuildSet() {
+	set := &protoSet{generation: self.set.generation + 1, protos: make([]*proto, len(self.lorder))}
+	for i, name := range self.lorder {
+		set.protos[i] = self.protos[name]
+	}
+	self.set = set
+}
+
 // listen interface, and rotate between different registered proto
 func (self *Dispatcher) Listen() error {
+	var tempDelay time.Duration
 	for {
-		conn, err := self.netl.Accept()
+		netl := self.baseListener()
+		conn, err := netl.Accept()
 		if err != nil {
-			if nerr, ok := err.(net.Error); ok {
-				if self.Logger != nil {
-					self.Logger.Println("munproto: " + nerr.Error())
-				}
+			if netl != self.baseListener() {
+				// base listener was replaced by SetListener, continue with the new one
+				tempDelay = 0
 				continue
 			}
 
-			for _, l := range self.listeners {
-				l.errCh <- err
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+
+				self.handleError(LogAcceptErrors, &AcceptError{Err: err, Delay: tempDelay})
+				time.Sleep(tempDelay)
+				continue
 			}
+
+			self.shutdown(err)
 			return err
 		}
+		tempDelay = 0
 
-		go self.dispatch(conn)
+		go self.DispatchConn(conn)
 	}
 }
 
-func (self *Dispatcher) dispatch(conn net.Conn) {
-	bufconn := newBufConn(conn)
+// detect the proto of conn and hand it to the matched listener, it is the part of Listen which can be used with a
+// custom accept loop. Safe for concurrent use, blocks until conn is delivered or closed, so it is usually called in
+// a separate goroutine.
+func (self *Dispatcher) DispatchConn(conn net.Conn) {
+	self.dispatch(newBufConn(conn))
+}
+
+// same as DispatchConn, but prebuf holds bytes which were already read from conn (e.g. by a PROXY protocol parser),
+// detection sees them first and then the rest of the stream.
+func (self *Dispatcher) DispatchConnBuffered(conn net.Conn, prebuf []byte) {
+	if len(prebuf) == 0 {
+		self.DispatchConn(conn)
+		return
+	}
+
+	size := len(prebuf)
+	if size < defaultBufSize {
+		size = defaultBufSize
+	}
+	self.dispatch(newBufConnSize(conn, io.MultiReader(bytes.NewReader(prebuf), conn), size))
+}
+
+// close the base listener, after that Accept of every listener returns an error satisfying errors.Is(err, net.ErrClosed)
+func (self *Dispatcher) Close() error {
+	self.shutdown(ErrDispatcherClosed)
+	return self.baseListener().Close()
+}
+
+// replace the base listener, e.g. with a socket inherited during a restart. The old listener is closed and Listen
+// continues to accept from the new one, virtual listeners and their pending connections are untouched.
+func (self *Dispatcher) SetListener(l net.Listener) error {
+	self.mu.Lock()
+	select {
+	case <-self.done:
+		self.mu.Unlock()
+		return self.err
+	default:
+	}
+
+	old := self.netl
+	self.netl = l
+	self.mu.Unlock()
+
+	return old.Close()
+}
+
+func (self *Dispatcher) baseListener() net.Listener {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.netl
+}
+
+func (self *Dispatcher) shutdown(err error) {
+	self.doneOnce.Do(func() {
+		if err != ErrDispatcherClosed {
+			err = &closedError{err}
+		}
+
+		self.mu.Lock()
+		defer self.mu.Unlock()
+
+		self.err = err
+		close(self.done)
+		for _, l := range self.listeners {
+			l.close(err)
+		}
+	})
+}
+
+func (self *Dispatcher) isDone() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *Dispatcher) handleError(category LogCategory, err error) {
+	if self.ErrorHandler != nil {
+		self.ErrorHandler(err)
+	}
+	if self.Logger != nil {
+		self.Logger.Println("munproto: " + err.Error())
+	}
+	if self.logger != nil && self.logCategories&category != 0 {
+		self.logError(category, err)
+	}
+}
+
+func (self *Dispatcher) dispatch(bufconn *bufConn) {
+	atomic.AddInt64(&self.counters.Dispatched, 1)
+	bufconn.id = atomic.AddUint64(&self.connIDs, 1)
+	rec := DispatchRecord{Time: time.Now(), ConnID: bufconn.id, Proto: UnmatchedProto}
+
+	self.mu.RLock()
+	set := self.set
+	unmatched := self.unmatched
+	self.mu.RUnlock()
+
+	// the set is immutable, falling through only reslices it
+	protos := set.protos
+	rec.Generation = set.generation
+
+	resume := false
+	for {
+		var p *proto
+		var err error
+		self.withLabels(func() {
+			p, err = self.detect(bufconn, protos, resume)
+		}, func() []string {
+			return []string{"phase", "detect", "remote", remoteLabel(bufconn.Conn.RemoteAddr())}
+		})
+
+		if self.route(bufconn, p, err, unmatched, &rec) {
+			return
+		}
+
+		// the listener of p was closed or removed concurrently, the conn falls through to the protos after it
+		for i := range protos {
+			if protos[i] == p {
+				protos = protos[i+1:]
+				break
+			}
+		}
+		rec.Proto, rec.ServerName = UnmatchedProto, ""
+		resume = true
+	}
+}
+
+// handle the result of detect, returns false if the listener of p is closed while the dispatcher is still running.
+func (self *Dispatcher) route(bufconn *bufConn, p *proto, err error, unmatched *forwarder, rec *DispatchRecord) bool {
+	rec.RemoteAddr = bufconn.RemoteAddr()
+	rec.DetectDuration = time.Since(rec.Time)
+	rec.Peeked = bufconn.r.Buffered()
+
+	if err == ErrAccessDenied {
+		rec.Proto = p.name
+		rec.Rejected = true
+		rec.Err = err
+		self.logDispatch(*rec)
+		self.recordError(bufconn, p.name, err)
+		self.reject(bufconn, p.name)
+		return true
+	}
+
+	if errors.Is(err, io.EOF) && rec.Peeked == 0 {
+		atomic.AddInt64(&self.counters.Empty, 1)
+		rec.Err = ErrEmptyConn
+		self.logDispatch(*rec)
+		bufconn.Close()
+		return true
+	}
+
+	if err != nil {
+		atomic.AddInt64(&self.counters.DetectErrors, 1)
+		// handshakes of WithPreDetectDeadline fail during detection, but are logged with the TLS errors
+		category := LogDetectErrors
+		var herr *TLSHandshakeError
+		if errors.As(err, &herr) {
+			category = LogTLSErrors
+		}
+		self.handleError(category, err)
+		rec.Err = err
+		self.logDispatch(*rec)
+		self.dumpConn(bufconn, err)
+		self.recordError(bufconn, "", err)
+		bufconn.Close()
+		return true
+	}
+
+	if p == nil {
+		atomic.AddInt64(&self.counters.Unmatched, 1)
+		rec.Err = ErrNoMatch
+		self.logDispatch(*rec)
+		self.dumpConn(bufconn, ErrNoMatch)
+		self.recordError(bufconn, "", ErrNoMatch)
+		if unmatched != nil {
+			bufconn.watchClose(self.OnConnClose, UnmatchedProto, rec.Time)
+			self.forward(bufconn, unmatched)
+		} else {
+			self.reject(bufconn, UnmatchedProto)
+		}
+		return true
+	}
+	rec.Proto = p.name
+	rec.ServerName = bufconn.serverName
+	if p.tracer != nil {
+		p.tracer.trace(bufconn, p.name)
+	}
+
+	self.mu.RLock()
+	ls := self.listeners[p.name]
+	f := self.forwards[p.name]
+	self.mu.RUnlock()
+
+	if f != nil {
+		self.logDispatch(*rec)
+		bufconn.watchClose(self.OnConnClose, p.name, rec.Time)
+		self.forward(bufconn, f)
+		return true
+	}
+	if ls == nil || ls.isClosed() && !self.isDone() {
+		return false
+	}
+
+	if !self.enqueue(ls, p) {
+		atomic.AddInt64(&self.counters.QueueRejected, 1)
+		rec.Rejected = true
+		rec.Err = ErrQueueFull
+		self.logDispatch(*rec)
+		self.recordError(bufconn, p.name, ErrQueueFull)
+		self.reject(bufconn, p.name)
+		return true
+	}
+
+	if idle := p.idleTimeout; idle > 0 || self.idleTimeout > 0 {
+		if idle == 0 {
+			idle = self.idleTimeout
+		}
+		bufconn.idleTimeout = idle
+	}
+	if age := p.maxConnAge; age > 0 || self.maxConnAge > 0 {
+		if age == 0 {
+			age = self.maxConnAge
+		}
+		bufconn.maxAge = age
+	}
+	bufconn.readLimit, bufconn.writeLimit = p.readLimit, p.writeLimit
+	bufconn.watchClose(self.OnConnClose, p.name, rec.Time)
+	bufconn.detectInfo.Start = rec.Time
+	bufconn.detectInfo.Decided = rec.Time.Add(rec.DetectDuration)
+	bufconn.detectInfo.Peeked = rec.Peeked
+
+	// if an Accept is parked already the runtime hands the conn straight to the first waiter, which is the only
+	// wakeup, and dispatch doesn't park
+	delivered := false
+	self.withLabels(func() {
+		select {
+		case ls.connCh <- bufconn:
+			delivered = true
+		case <-ls.done:
+		}
+	}, func() []string {
+		return []string{"phase", "deliver", "proto", p.name, "remote", remoteLabel(rec.RemoteAddr)}
+	})
+	ls.dequeue()
 
+	if !delivered {
+		if !self.isDone() {
+			bufconn.untrack()
+			return false
+		}
+		rec.Err = ls.err
+		bufconn.Close()
+	} else {
+		// the time a conn waits in the queue doesn't count towards its idle timeout and max age
+		bufconn.startTimers(func() {
+			atomic.AddInt64(&self.counters.IdleClosed, 1)
+		}, func() {
+			atomic.AddInt64(&self.counters.MaxAgeClosed, 1)
+		})
+		atomic.AddInt64(&self.counters.Delivered, 1)
+	}
+	self.logDispatch(*rec)
+	return true
+}
+
+// run the detectors over conn and return the first matching proto, nil if none matched. If the policy of the proto
+// denies the client ErrAccessDenied is returned along with the proto. The read deadline is cleared unless an error is
+// returned.
+func (self *Dispatcher) detect(bufconn *bufConn, protos []*proto, resume bool) (*proto, error) {
+	conn := bufconn.Conn
+
+	var deadline, current time.Time
 	if self.timeout > 0 {
-		conn.SetReadDeadline(time.Now().Add(self.timeout))
+		deadline = time.Now().Add(self.timeout)
+	}
+
+	if self.preDetect > 0 && !resume {
+		current = time.Now().Add(self.preDetect)
+		conn.SetDeadline(current)
+		if err := self.predetect(bufconn); err != nil {
+			return nil, err
+		}
+		conn.SetWriteDeadline(time.Time{})
 	}
 
-	for _, proto := range self.lorder {
-		ls := self.listeners[proto]
+	if self.ProxyProtocol && !resume {
+		if current.IsZero() && !deadline.IsZero() {
+			conn.SetReadDeadline(deadline)
+			current = deadline
+		}
 
-		resolver := defaultProtos[ls.proto]
-		isSuitableProto, err := resolver(bufconn.r)
+		h, err := ReadProxyHeader(bufconn.r)
 		if err != nil {
-			if self.Logger != nil {
-				self.Logger.Println("munproto: " + err.Error())
+			return nil, err
+		}
+		bufconn.proxy = h
+	}
+
+	if self.snapshot > bufconn.r.Size() {
+		bufconn.grow()
+	}
+
+	var matched *proto
+	var results *dataResults
+	for i, p := range protos {
+		if p.requireTLS && !isTLSConn(bufconn.Conn) {
+			continue
+		}
+
+		dl := deadline
+		if p.timeout > 0 {
+			dl = time.Now().Add(p.timeout)
+		}
+		if dl != current || bufconn.graced {
+			conn.SetReadDeadline(dl)
+			current, bufconn.deadline, bufconn.graced = dl, dl, false
+		}
+		bufconn.grace = p.headGrace
+		if bufconn.grace == 0 {
+			bufconn.grace = self.headGrace
+		}
+
+		var start time.Time
+		if self.ObserveDetect != nil {
+			start = time.Now()
+		}
+		bufconn.detectInfo.Evaluated++
+		if p.datafn != nil && results == nil {
+			results = newDataResults(len(protos))
+		}
+		isSuitableProto, err := self.runDetector(protos, i, bufconn, results)
+		if self.ObserveDetect != nil {
+			self.ObserveDetect(p.name, time.Since(start))
+		}
+
+		if err != nil {
+			atomic.AddInt64(&p.counts.errors, 1)
+			if isTimeout(err) && i < len(protos)-1 {
+				continue
 			}
-			return
+			return nil, &DetectionError{ConnID: bufconn.id, Proto: p.name, Err: err}
+		}
+
+		if !isSuitableProto {
+			atomic.AddInt64(&p.counts.unmatched, 1)
+			continue
 		}
 
-		if isSuitableProto {
-			if self.timeout > 0 {
-				conn.SetReadDeadline(time.Time{})
+		atomic.AddInt64(&p.counts.matched, 1)
+		if p.policy != nil && !p.policy.allowed(bufconn.RemoteAddr()) {
+			self.denied(p.name, bufconn.RemoteAddr())
+			if p.policy.fallThrough {
+				continue
 			}
+			return p, ErrAccessDenied
+		}
 
-			ls.connCh <- bufconn
-			return
+		matched = p
+		break
+	}
+
+	if matched != nil && (matched.tlsInfo || self.tlsInfo) {
+		if data, _ := bufconn.r.Peek(1); len(data) > 0 && data[0] == recordTypeHandshake {
+			bufconn.grow()
+			if msg, err := peekClientHello(bufconn.r); err == nil {
+				if info, ok := parseClientHello(msg); ok {
+					bufconn.hello = &info
+					bufconn.serverName = info.ServerName
+				}
+			}
+		}
+	}
+
+	if !current.IsZero() || bufconn.graced {
+		conn.SetReadDeadline(time.Time{})
+	}
+	bufconn.grace, bufconn.graced = 0, false
+	return matched, nil
+}
+
+// complete the TLS handshake, if conn is a TLS conn, and wait for the first byte.
+func (self *Dispatcher) predetect(bufconn *bufConn) error {
+	if tlsconn, ok := bufconn.Conn.(interface{ Handshake() error }); ok {
+		if err := tlsconn.Handshake(); err != nil {
+			return &TLSHandshakeError{ConnID: bufconn.id, RemoteAddr: bufconn.Conn.RemoteAddr(), Err: err}
 		}
 	}
 
-	bufconn.Close()
+	_, err := bufconn.r.Peek(1)
+	return err
 }
 
+// run the detector of protos[i]. If it needs more bytes than fit into the small detection buffer it is run again
+// with the full size buffer, if they don't fit into it either the conn doesn't match. A panic is recovered and
+// returned as *PanicError, so the conn is closed and the dispatcher keeps running.
+func (self *Dispatcher) runDetector(protos []*proto, i int, bufconn *bufConn, results *dataResults) (ok bool, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			atomic.AddInt64(&self.counters.Panics, 1)
+			ok, err = false, &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+
+	p := protos[i]
+	if p.datafn != nil {
+		return runData(protos, i, bufconn, results)
+	}
+
+	detectfn := p.detectfn
+	if p.connfn != nil {
+		detectfn = func(r *bufio.Reader) (bool, error) {
+			return p.connfn(bufconn, r)
+		}
+	}
+
+	ok, err = detectfn(bufconn.r)
+	if err == bufio.ErrBufferFull && bufconn.grow() {
+		ok, err = detectfn(bufconn.r)
+	}
+	if err == bufio.ErrBufferFull {
+		return false, nil
+	}
+	return ok, err
+}
+
+func (self *Dispatcher) logDispatch(rec DispatchRecord) {
+	if self.AccessLog != nil {
+		self.AccessLog(rec)
+	}
+}
+
+// detection starts with the small buffer, which is enough for most detectors, and grows to the default size only if
+// a detector peeks more
+const (
+	smallBufSize   = 64
+	defaultBufSize = 4096
+)
+
 // todo: добавить пул
 type bufConn struct {
+	// unix nano time of the last read or write, accessed atomically
+	lastActivity int64
+	// unique among the conns of the dispatcher, assigned sequentially from 1
+	id uint64
+	// bytes read and written, including those buffered during detection, accessed atomically
+	bytesRead    int64
+	bytesWritten int64
+
 	r *bufio.Reader
 	net.Conn
+
+	// the stream read by r through detectSource
+	src io.Reader
+
+	// the read deadline set by detect and the grace timeout of WithHeadGrace of the running detector. graced is set
+	// when detectSource shortened the deadline, received once any bytes were read.
+	deadline time.Time
+	grace    time.Duration
+	graced   bool
+	received bool
+
+	proxy      *ProxyHeader
+	serverName string
+	hello      *ClientHelloInfo
+	origDst    netip.AddrPort
+	detectInfo DetectionInfo
+
+	idleTimeout time.Duration
+	maxAge      time.Duration
+
+	// guards the timers and closed, the timers are started after delivery, concurrently with the handler
+	timerMu   sync.Mutex
+	idleTimer *time.Timer
+	ageTimer  *time.Timer
+	closed    bool
+
+	readLimit  *bucket
+	writeLimit *bucket
+
+	// called on Close, set by watchClose
+	closeHook func(rec ConnCloseRecord)
+	closeOnce sync.Once
+	proto     string
+	opened    time.Time
 }
 
+// read the bytes buffered during detection first, they are returned regardless of the read deadline. Once the
+// buffer is drained reads go directly to the conn, so the deadline applies and errors from detection, like an
+// expired detection deadline, aren't returned.
 func (self *bufConn) Read(b []byte) (n int, err error) {
-	return self.r.Read(b)
+	if self.readLimit != nil && len(b) > maxThrottleChunk {
+		b = b[:maxThrottleChunk]
+	}
+
+	if self.r.Buffered() > 0 {
+		n, err = self.r.Read(b)
+	} else {
+		n, err = self.src.Read(b)
+	}
+	atomic.AddInt64(&self.bytesRead, int64(n))
+	if self.idleTimeout > 0 {
+		self.touch()
+	}
+	if self.readLimit != nil && n > 0 {
+		self.readLimit.wait(n)
+	}
+	return n, err
+}
+
+func (self *bufConn) Write(b []byte) (n int, err error) {
+	if self.writeLimit == nil {
+		n, err = self.Conn.Write(b)
+		atomic.AddInt64(&self.bytesWritten, int64(n))
+		if self.idleTimeout > 0 {
+			self.touch()
+		}
+		return n, err
+	}
+
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxThrottleChunk {
+			chunk = chunk[:maxThrottleChunk]
+		}
+		self.writeLimit.wait(len(chunk))
+
+		m, err := self.Conn.Write(chunk)
+		n += m
+		atomic.AddInt64(&self.bytesWritten, int64(m))
+		if self.idleTimeout > 0 {
+			self.touch()
+		}
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// the fast paths of io.Copy bypass Read and Write, so they can't be used when reads or writes must be tracked
+func (self *bufConn) tracked() bool {
+	return self.idleTimeout > 0 || self.readLimit != nil || self.writeLimit != nil
+}
+
+func (self *bufConn) Close() error {
+	self.timerMu.Lock()
+	self.stopTimers()
+	self.timerMu.Unlock()
+	return self.close()
+}
+
+// mark the conn closed and stop its timers, timerMu must be held.
+func (self *bufConn) stopTimers() {
+	self.closed = true
+	if self.idleTimer != nil {
+		self.idleTimer.Stop()
+	}
+	if self.ageTimer != nil {
+		self.ageTimer.Stop()
+	}
+}
+
+func (self *bufConn) close() error {
+	err := self.Conn.Close()
+	if self.closeHook != nil {
+		self.closeOnce.Do(func() {
+			self.closeHook(ConnCloseRecord{
+				Proto:        self.proto,
+				ConnID:       self.id,
+				RemoteAddr:   self.RemoteAddr(),
+				BytesRead:    atomic.LoadInt64(&self.bytesRead),
+				BytesWritten: atomic.LoadInt64(&self.bytesWritten),
+				Duration:     time.Since(self.opened),
+				Err:          err,
+			})
+		})
+	}
+	return err
+}
+
+// call hook with the record of the conn when it is closed, must be called before the conn is delivered.
+func (self *bufConn) watchClose(hook func(rec ConnCloseRecord), proto string, opened time.Time) {
+	self.closeHook, self.proto, self.opened = hook, proto, opened
+}
+
+// undo the timeouts and limits set for delivery, when the conn falls through to another proto.
+func (self *bufConn) untrack() {
+	self.timerMu.Lock()
+	defer self.timerMu.Unlock()
+	self.idleTimeout, self.maxAge = 0, 0
+	self.readLimit, self.writeLimit = nil, nil
+	self.closeHook = nil
+}
+
+// start the timers of the idle timeout and max age, called once the conn was delivered. idled and aged are called
+// when the conn is closed for being idle or for its max age. Nothing is started if the handler closed the conn
+// already.
+func (self *bufConn) startTimers(idled, aged func()) {
+	self.timerMu.Lock()
+	defer self.timerMu.Unlock()
+	if self.closed {
+		return
+	}
+
+	if self.idleTimeout > 0 {
+		self.touch()
+		self.idleTimer = time.AfterFunc(self.idleTimeout, func() {
+			self.checkIdle(idled)
+		})
+	}
+	if self.maxAge > 0 {
+		self.ageTimer = time.AfterFunc(self.maxAge, func() {
+			self.timerMu.Lock()
+			if self.closed {
+				self.timerMu.Unlock()
+				return
+			}
+			self.stopTimers()
+			self.timerMu.Unlock()
+
+			aged()
+			self.close()
+		})
+	}
+}
+
+func (self *bufConn) touch() {
+	atomic.StoreInt64(&self.lastActivity, time.Now().UnixNano())
+}
+
+func (self *bufConn) checkIdle(idled func()) {
+	self.timerMu.Lock()
+	if self.closed {
+		self.timerMu.Unlock()
+		return
+	}
+
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&self.lastActivity)))
+	if idle < self.idleTimeout {
+		self.idleTimer.Reset(self.idleTimeout - idle)
+		self.timerMu.Unlock()
+		return
+	}
+	self.stopTimers()
+	self.timerMu.Unlock()
+
+	idled()
+	self.close()
+}
+
+func (self *bufConn) RemoteAddr() net.Addr {
+	if self.proxy != nil && self.proxy.Source != nil {
+		return self.proxy.Source
+	}
+	return self.Conn.RemoteAddr()
+}
+
+func (self *bufConn) LocalAddr() net.Addr {
+	if self.proxy != nil && self.proxy.Destination != nil {
+		return self.proxy.Destination
+	}
+	return self.Conn.LocalAddr()
+}
+
+// return the number of bytes buffered during detection which are not read yet, reads of up to this many bytes don't
+// block and ignore the read deadline.
+func (self *bufConn) Buffered() int {
+	return self.r.Buffered()
+}
+
+// write the buffered bytes to w and then copy the rest of the stream directly, which lets the underlying conn use
+// its fast path (e.g. splice for TCP).
+func (self *bufConn) WriteTo(w io.Writer) (int64, error) {
+	if self.tracked() {
+		return io.Copy(w, readerOnly{self})
+	}
+
+	data, _ := self.r.Peek(self.r.Buffered())
+	n, err := w.Write(data)
+	self.r.Discard(n)
+	atomic.AddInt64(&self.bytesRead, int64(n))
+	if err != nil {
+		return int64(n), err
+	}
+
+	m, err := io.Copy(w, self.src)
+	atomic.AddInt64(&self.bytesRead, m)
+	return int64(n) + m, err
+}
+
+func (self *bufConn) ReadFrom(r io.Reader) (int64, error) {
+	if self.tracked() {
+		return io.Copy(writerOnly{self}, r)
+	}
+
+	n, err := io.Copy(self.Conn, r)
+	atomic.AddInt64(&self.bytesWritten, n)
+	return n, err
+}
+
+// readerOnly and writerOnly hide the io.WriterTo and io.ReaderFrom implementations of the wrapped conn from io.Copy
+type readerOnly struct {
+	io.Reader
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+func (self *bufConn) CloseWrite() error {
+	if cw, ok := self.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// return the wrapped conn. Reading from it directly skips the bytes buffered during detection, see Underlying.
+func (self *bufConn) Unwrap() net.Conn {
+	return self.Conn
+}
+
+// return the innermost conn of conn, e.g. the *net.TCPConn for SetNoDelay or File, by walking the wrappers which
+// implement Unwrap() net.Conn or NetConn() net.Conn (like *tls.Conn). Reading from the result directly skips the bytes
+// of a dispatched conn which were buffered during detection but not read yet, so while there are any the dispatched
+// conn itself is returned, unless force is set. Writing to or reading from the result of a TLS conn bypasses TLS.
+func Underlying(conn net.Conn, force bool) net.Conn {
+	for {
+		if c, ok := conn.(*bufConn); ok && !force && c.Buffered() > 0 {
+			return conn
+		}
+
+		switch c := conn.(type) {
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return conn
+		}
+	}
 }
 
 func newBufConn(c net.Conn) *bufConn {
-	return &bufConn{bufio.NewReader(c), c}
+	return newBufConnSize(c, c, smallBufSize)
+}
+
+// create bufConn reading the stream src of c with a detection buffer of size bytes.
+func newBufConnSize(c net.Conn, src io.Reader, size int) *bufConn {
+	bufconn := &bufConn{Conn: c, src: src}
+	bufconn.r = bufio.NewReaderSize(detectSource{bufconn}, size)
+	return bufconn
+}
+
+// detectSource is the reader of the detection buffer. Once bytes were received it bounds the wait for more by the
+// grace timeout of WithHeadGrace. The buffer is only filled during detection, delivered conns read src directly once
+// it is drained.
+type detectSource struct {
+	c *bufConn
+}
+
+func (self detectSource) Read(b []byte) (int, error) {
+	c := self.c
+	if c.grace > 0 && c.received {
+		dl := time.Now().Add(c.grace)
+		if !c.deadline.IsZero() && c.deadline.Before(dl) {
+			dl = c.deadline
+		}
+		c.Conn.SetReadDeadline(dl)
+		c.graced = true
+	}
+
+	n, err := c.src.Read(b)
+	if n > 0 {
+		c.received = true
+	}
+	return n, err
+}
+
+// replace the small detection buffer with one of the default size, returns false if it is already that large. The
+// buffered bytes are moved into the new reader, which reads the stream directly after them, so no bytes stay behind
+// in the small one: Read and WriteTo bypass the buffer once it is drained and would skip them.
+func (self *bufConn) grow() bool {
+	if self.r.Size() >= defaultBufSize {
+		return false
+	}
+
+	buffered, _ := self.r.Peek(self.r.Buffered())
+	buffered = append([]byte{}, buffered...)
+	self.r = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(buffered), detectSource{self}), defaultBufSize)
+	self.r.Peek(len(buffered))
+	return true
+}
+
+// return the id the dispatcher assigned to conn, which is also recorded in DispatchRecord, TraceRecord and the errors
+// of the conn. It is 0 if conn wasn't delivered by a dispatcher.
+func ConnID(conn net.Conn) uint64 {
+	if c := bufConnOf(conn); c != nil {
+		return c.id
+	}
+	return 0
+}
+
+// DetectionInfo describes the detection of a delivered conn.
+type DetectionInfo struct {
+	// when the detection started and when the proto was decided
+	Start   time.Time
+	Decided time.Time
+	// the number of bytes peeked during detection
+	Peeked int
+	// the number of detectors run, including those of earlier protos which didn't match
+	Evaluated int
+}
+
+// return the detection info of conn, ok is false if conn wasn't delivered by a dispatcher.
+func DetectInfo(conn net.Conn) (info DetectionInfo, ok bool) {
+	c := bufConnOf(conn)
+	if c == nil || c.detectInfo.Start.IsZero() {
+		return DetectionInfo{}, false
+	}
+	return c.detectInfo, true
+}
+
+// return the bufConn of a conn delivered by the dispatcher, also if it was wrapped with TLS by TLSListener.
+func bufConnOf(conn net.Conn) *bufConn {
+	for {
+		switch c := conn.(type) {
+		case *bufConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
 }
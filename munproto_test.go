@@ -0,0 +1,1263 @@
+package munproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary failure" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// scriptListener returns the results of script from Accept in order, then errClosed.
+type scriptListener struct {
+	mu     sync.Mutex
+	script []error
+}
+
+var errClosed = errors.New("closed")
+
+func (self *scriptListener) Accept() (net.Conn, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if len(self.script) == 0 {
+		return nil, errClosed
+	}
+	err := self.script[0]
+	self.script = self.script[1:]
+	if err != nil {
+		return nil, err
+	}
+
+	client, server := net.Pipe()
+	client.Close()
+	return server, nil
+}
+
+func (self *scriptListener) Close() error   { return nil }
+func (self *scriptListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestListenBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []error
+		delays []time.Duration
+	}{
+		{
+			name:   "doubling",
+			script: []error{tempError{}, tempError{}, tempError{}},
+			delays: []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			name:   "reset after accept",
+			script: []error{tempError{}, tempError{}, nil, tempError{}},
+			delays: []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 5 * time.Millisecond},
+		},
+		{
+			name:   "no temporary errors",
+			script: []error{nil, nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := munproto.New(&scriptListener{script: tt.script}, time.Second)
+
+			var delays []time.Duration
+			d.ErrorHandler = func(err error) {
+				var aerr *munproto.AcceptError
+				if !errors.As(err, &aerr) {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if _, ok := aerr.Err.(tempError); !ok {
+					t.Errorf("AcceptError.Err = %v", aerr.Err)
+				}
+				delays = append(delays, aerr.Delay)
+			}
+
+			if err := d.Listen(); !errors.Is(err, errClosed) {
+				t.Fatalf("Listen() = %v, want %v", err, errClosed)
+			}
+			if len(delays) != len(tt.delays) {
+				t.Fatalf("delays = %v, want %v", delays, tt.delays)
+			}
+			for i := range delays {
+				if delays[i] != tt.delays[i] {
+					t.Fatalf("delays = %v, want %v", delays, tt.delays)
+				}
+			}
+		})
+	}
+}
+
+func TestListenBackoffLimit(t *testing.T) {
+	script := make([]error, 10)
+	for i := range script {
+		script[i] = tempError{}
+	}
+	d := munproto.New(&scriptListener{script: script}, time.Second)
+
+	var last time.Duration
+	d.ErrorHandler = func(err error) {
+		var aerr *munproto.AcceptError
+		if errors.As(err, &aerr) {
+			last = aerr.Delay
+		}
+	}
+	if testing.Short() {
+		t.Skip("sleeps for several seconds")
+	}
+
+	d.Listen()
+	if last != time.Second {
+		t.Fatalf("last delay = %v, want 1s", last)
+	}
+}
+
+func TestAcceptReturnsAfterListenExits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := munproto.NewDefault(l)
+	listeners := []net.Listener{d.Listener("http"), d.Listener("socks5")}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- d.Listen()
+	}()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			_, err := l.Accept()
+			errs <- err
+		}(l)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+
+	timeout := time.After(time.Second)
+	for range listeners {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Errorf("Accept() = %v, want net.ErrClosed", err)
+			}
+		case <-timeout:
+			t.Fatal("Accept didn't return after the base listener was closed")
+		}
+	}
+	if err := <-listenErr; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Listen() = %v, want net.ErrClosed", err)
+	}
+
+	// listeners created after shutdown fail right away
+	if _, err := d.Listener("https").Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after shutdown = %v, want net.ErrClosed", err)
+	}
+}
+
+// send a HTTP request line over conn and close it
+func sendHTTP(t *testing.T, conn net.Conn, path string) {
+	t.Helper()
+	if _, err := conn.Write([]byte("GET " + path + " HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// read the request line of a conn delivered by the dispatcher
+func readRequestLine(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestSetListener(t *testing.T) {
+	old, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := munproto.NewDefault(old)
+	l := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	// queued before the swap, accepted after it
+	queued, err := net.Dial("tcp", old.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queued.Close()
+	sendHTTP(t, queued, "/before")
+	time.Sleep(20 * time.Millisecond)
+
+	replacement, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetListener(replacement); err != nil {
+		t.Fatal(err)
+	}
+	if l.Addr().String() != replacement.Addr().String() {
+		t.Errorf("Addr() = %v, want %v", l.Addr(), replacement.Addr())
+	}
+	if _, err := net.Dial("tcp", old.Addr().String()); err == nil {
+		t.Error("old listener still accepts")
+	}
+
+	conn, err := net.Dial("tcp", replacement.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendHTTP(t, conn, "/after")
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[readRequestLine(t, c)] = true
+		c.Close()
+	}
+	for _, line := range []string{"GET /before HTTP/1.1", "GET /after HTTP/1.1"} {
+		if !got[line] {
+			t.Errorf("conn %q lost, got %v", line, got)
+		}
+	}
+}
+
+func TestSetListenerAfterClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := munproto.NewDefault(l)
+	d.Close()
+
+	replacement, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replacement.Close()
+	if err := d.SetListener(replacement); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("SetListener() after Close = %v, want net.ErrClosed", err)
+	}
+}
+
+// accept a conn from l, fails the test if none is delivered within timeout
+func acceptWithin(t *testing.T, l net.Listener, timeout time.Duration) net.Conn {
+	t.Helper()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		return res.conn
+	case <-time.After(timeout):
+		t.Fatal("no conn delivered")
+		return nil
+	}
+}
+
+// return the next error reported to the ErrorHandler, fails the test if none is reported
+func nextError(t *testing.T, errs chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("no error reported")
+		return nil
+	}
+}
+
+func TestIdleTimeoutCloses(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl, munproto.WithIdleTimeout(50*time.Millisecond))
+	http := d.Listener("http")
+	closed := make(chan munproto.ConnCloseRecord, 2)
+	d.OnConnClose = func(rec munproto.ConnCloseRecord) {
+		closed <- rec
+	}
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET / HTTP/1.1\r\n\r\n"
+	go conn.Write([]byte(request))
+
+	delivered := acceptWithin(t, http, time.Second)
+	defer delivered.Close()
+	if _, err := io.ReadFull(delivered, make([]byte, len(request))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the handler waits for more bytes, which never come
+	start := time.Now()
+	if _, err := delivered.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from an idle conn succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("idle conn closed after %v", elapsed)
+	}
+
+	select {
+	case rec := <-closed:
+		if rec.Proto != "http" {
+			t.Fatalf("OnConnClose proto = %q, want http", rec.Proto)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnClose not called for the idle conn")
+	}
+	delivered.Close()
+	if len(closed) != 0 {
+		t.Fatal("OnConnClose called again by the handler")
+	}
+	if stats := d.Stats(); stats.IdleClosed != 1 || stats.MaxAgeClosed != 0 {
+		t.Fatalf("IdleClosed, MaxAgeClosed = %d, %d, want 1, 0", stats.IdleClosed, stats.MaxAgeClosed)
+	}
+}
+
+func TestMaxConnAgeCloses(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl, munproto.WithMaxConnAge(100*time.Millisecond))
+	http := d.Listener("http")
+	closed := make(chan munproto.ConnCloseRecord, 2)
+	d.OnConnClose = func(rec munproto.ConnCloseRecord) {
+		closed <- rec
+	}
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		// keep the conn busy, the max age applies regardless of activity
+		for {
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	delivered := acceptWithin(t, http, time.Second)
+	defer delivered.Close()
+	start := time.Now()
+	for {
+		if _, err := delivered.Read(make([]byte, 64)); err != nil {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("active conn closed after %v, want its max age", elapsed)
+	}
+
+	select {
+	case rec := <-closed:
+		if rec.Proto != "http" {
+			t.Fatalf("OnConnClose proto = %q, want http", rec.Proto)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnClose not called for the aged conn")
+	}
+	delivered.Close()
+	if len(closed) != 0 {
+		t.Fatal("OnConnClose called again by the handler")
+	}
+	if stats := d.Stats(); stats.MaxAgeClosed != 1 || stats.IdleClosed != 0 {
+		t.Fatalf("MaxAgeClosed, IdleClosed = %d, %d, want 1, 0", stats.MaxAgeClosed, stats.IdleClosed)
+	}
+}
+
+func TestEmptyConns(t *testing.T) {
+	const conns = 1000
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.Listener("http")
+
+	var errs, logged int64
+	d.ErrorHandler = func(err error) {
+		atomic.AddInt64(&errs, 1)
+	}
+	d.AccessLog = func(rec munproto.DispatchRecord) {
+		if !errors.Is(rec.Err, munproto.ErrEmptyConn) {
+			t.Errorf("DispatchRecord.Err = %v, want ErrEmptyConn", rec.Err)
+		}
+		atomic.AddInt64(&logged, 1)
+	}
+	go d.Listen()
+	defer d.Close()
+
+	for i := 0; i < conns; i++ {
+		conn, err := pl.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&logged) < conns && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := d.Stats(); stats.Empty != conns || stats.DetectErrors != 0 {
+		t.Fatalf("Empty = %d, DetectErrors = %d, want %d, 0", stats.Empty, stats.DetectErrors, conns)
+	}
+	if n := atomic.LoadInt64(&errs); n != 0 {
+		t.Fatalf("ErrorHandler called %d times for empty conns", n)
+	}
+	if n := atomic.LoadInt64(&logged); n != conns {
+		t.Fatalf("AccessLog called %d times, want %d", n, conns)
+	}
+}
+
+func TestListenerDuplicate(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+
+	var calls int64
+	d.AddProto("count", func(r *bufio.Reader) (bool, error) {
+		atomic.AddInt64(&calls, 1)
+		return false, nil
+	})
+	d.AddProto("http", munproto.IsHTTP)
+
+	l := d.Listener("count")
+	if again := d.Listener("count"); again != l {
+		t.Fatal("Listener returned a new listener for the same proto")
+	}
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	acceptWithin(t, http, time.Second).Close()
+
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("detector called %d times, want 1", n)
+	}
+	var evaluated []string
+	for _, p := range d.DebugState().Protos {
+		if p.Evaluated {
+			evaluated = append(evaluated, p.Name)
+		}
+	}
+	if strings.Join(evaluated, ",") != "count,http" {
+		t.Fatalf("evaluated protos = %v, want [count http]", evaluated)
+	}
+}
+
+// collect the DispatchRecords of d
+func accessLog(d *munproto.Dispatcher) chan munproto.DispatchRecord {
+	recs := make(chan munproto.DispatchRecord, 16)
+	d.AccessLog = func(rec munproto.DispatchRecord) {
+		recs <- rec
+	}
+	return recs
+}
+
+// wait for the next record and check that no other follows it
+func onlyRecord(t *testing.T, recs chan munproto.DispatchRecord) munproto.DispatchRecord {
+	t.Helper()
+	var rec munproto.DispatchRecord
+	select {
+	case rec = <-recs:
+	case <-time.After(time.Second):
+		t.Fatal("AccessLog not called")
+	}
+	select {
+	case extra := <-recs:
+		t.Fatalf("AccessLog called again with %+v after %+v", extra, rec)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return rec
+}
+
+func dialHTTP(t *testing.T, pl *munprototest.PipeListener) net.Conn {
+	t.Helper()
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	return conn
+}
+
+func TestAccessLogDelivered(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	http := d.Listener("http")
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+
+	dialHTTP(t, pl)
+	acceptWithin(t, http, time.Second).Close()
+	if rec := onlyRecord(t, recs); rec.Err != nil || rec.Rejected || rec.Proto != "http" || rec.Peeked == 0 {
+		t.Fatalf("DispatchRecord = %+v, want a delivered http conn", rec)
+	}
+}
+
+func TestAccessLogUnmatched(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.Listener("http")
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("\xde\xad\xbe\xef not a known proto\r\n"))
+	if rec := onlyRecord(t, recs); !errors.Is(rec.Err, munproto.ErrNoMatch) || rec.Rejected || rec.Proto != munproto.UnmatchedProto {
+		t.Fatalf("DispatchRecord = %+v, want an unmatched conn", rec)
+	}
+}
+
+func TestAccessLogDenied(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.Listener("http")
+	// pipe conns have no IP address, so no allow list contains them
+	if err := d.Restrict("http", munproto.AllowCIDRs("10.0.0.0/8")); err != nil {
+		t.Fatal(err)
+	}
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+
+	dialHTTP(t, pl)
+	if rec := onlyRecord(t, recs); !errors.Is(rec.Err, munproto.ErrAccessDenied) || !rec.Rejected || rec.Proto != "http" {
+		t.Fatalf("DispatchRecord = %+v, want a denied http conn", rec)
+	}
+}
+
+func TestAccessLogForwarded(t *testing.T) {
+	upstream := startUpstream(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	if err := d.Forward("http", upstream); err != nil {
+		t.Fatal(err)
+	}
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+
+	dialHTTP(t, pl)
+	if rec := onlyRecord(t, recs); rec.Err != nil || rec.Rejected || rec.Proto != "http" {
+		t.Fatalf("DispatchRecord = %+v, want a forwarded http conn", rec)
+	}
+}
+
+func TestAccessLogQueueFull(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl, munproto.WithHighWater(1, true))
+	http := d.Listener("http")
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+
+	// the first conn waits for Accept, the second exceeds the high-water mark
+	dialHTTP(t, pl)
+	waitListenerStats(t, http.(munproto.StatsProvider), func(s munproto.ListenerStats) bool { return s.Pending == 1 })
+	dialHTTP(t, pl)
+	if rec := onlyRecord(t, recs); !errors.Is(rec.Err, munproto.ErrQueueFull) || !rec.Rejected || rec.Proto != "http" {
+		t.Fatalf("DispatchRecord = %+v, want a rejected http conn", rec)
+	}
+
+	acceptWithin(t, http, time.Second).Close()
+	if rec := onlyRecord(t, recs); rec.Err != nil || rec.Rejected {
+		t.Fatalf("DispatchRecord = %+v, want the queued conn delivered", rec)
+	}
+}
+
+func TestAccessLogDispatcherClosed(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	http := d.Listener("http")
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+
+	// nobody accepts the conn before the dispatcher is closed
+	dialHTTP(t, pl)
+	waitListenerStats(t, http.(munproto.StatsProvider), func(s munproto.ListenerStats) bool { return s.Pending == 1 })
+	d.Close()
+	if rec := onlyRecord(t, recs); !errors.Is(rec.Err, munproto.ErrDispatcherClosed) || rec.Rejected || rec.Proto != "http" {
+		t.Fatalf("DispatchRecord = %+v, want an http conn not delivered because of the shutdown", rec)
+	}
+}
+
+func TestBufferedExpiredDeadline(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET / HTTP/1.1\r\n\r\n"
+	go conn.Write([]byte(request))
+
+	delivered := acceptWithin(t, http, time.Second)
+	defer delivered.Close()
+	if n := delivered.(interface{ Buffered() int }).Buffered(); n != len(request) {
+		t.Fatalf("Buffered() = %d, want %d", n, len(request))
+	}
+
+	// the buffered bytes are returned although the deadline expired
+	delivered.SetReadDeadline(time.Now().Add(-time.Second))
+	got := make([]byte, len(request))
+	if _, err := io.ReadFull(delivered, got); err != nil || string(got) != request {
+		t.Fatalf("read %q, %v, want the buffered request", got, err)
+	}
+
+	// the rest of the stream is subject to the deadline
+	if _, err := delivered.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read after the buffered bytes: %v, want a timeout", err)
+	}
+}
+
+func TestDispatchConnBuffered(t *testing.T) {
+	tests := []struct {
+		name   string
+		prebuf string
+		rest   string
+	}{
+		{"split", "GET / HT", "TP/1.1\r\n\r\n"},
+		{"all buffered", "GET / HTTP/1.1\r\n\r\n", ""},
+		{"empty", "", "GET / HTTP/1.1\r\n\r\n"},
+		// larger than the default buffer
+		{"large", string(httpHead(6000)), "tail"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := munproto.NewDefault(munprototest.NewPipeListener())
+			http := d.Listener("http")
+			defer d.Close()
+
+			client, server := net.Pipe()
+			defer client.Close()
+			go d.DispatchConnBuffered(server, []byte(tt.prebuf))
+			if tt.rest != "" {
+				go client.Write([]byte(tt.rest))
+			}
+
+			delivered := acceptWithin(t, http, time.Second)
+			defer delivered.Close()
+			want := tt.prebuf + tt.rest
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(delivered, got); err != nil || string(got) != want {
+				t.Fatalf("read %q, %v, want %q", got, err, want)
+			}
+		})
+	}
+}
+
+func TestObserveDetect(t *testing.T) {
+	const delay = 30 * time.Millisecond
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddProto("slow", func(r *bufio.Reader) (bool, error) {
+		time.Sleep(delay)
+		return false, nil
+	})
+	d.AddProto("http", munproto.IsHTTP)
+	d.Listener("slow")
+	http := d.Listener("http")
+	type observation struct {
+		proto string
+		d     time.Duration
+	}
+	observed := make(chan observation, 4)
+	d.ObserveDetect = func(proto string, d time.Duration) {
+		observed <- observation{proto, d}
+	}
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+
+	dialHTTP(t, pl)
+	acceptWithin(t, http, time.Second).Close()
+
+	// one observation per detector, in the order they ran
+	slow, fast := <-observed, <-observed
+	if slow.proto != "slow" || slow.d < delay || fast.proto != "http" || fast.d >= delay {
+		t.Fatalf("ObserveDetect(%q, %v), (%q, %v), want slow at least %v and a fast http", slow.proto, slow.d, fast.proto, fast.d, delay)
+	}
+	if rec := onlyRecord(t, recs); rec.DetectDuration < slow.d+fast.d {
+		t.Fatalf("DetectDuration = %v, want at least the detectors' %v", rec.DetectDuration, slow.d+fast.d)
+	}
+	if len(observed) != 0 {
+		t.Fatalf("ObserveDetect called %d more times", len(observed))
+	}
+}
+
+func TestDetectInfo(t *testing.T) {
+	const delay = 20 * time.Millisecond
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddProto("slow", func(r *bufio.Reader) (bool, error) {
+		time.Sleep(delay)
+		return false, nil
+	})
+	d.AddProto("http", munproto.IsHTTP)
+	d.Listener("slow")
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	start := time.Now()
+	request := "GET / HTTP/1.1\r\n\r\n"
+	dialHTTP(t, pl)
+	delivered := acceptWithin(t, http, time.Second)
+	defer delivered.Close()
+
+	info, ok := munproto.DetectInfo(delivered)
+	if !ok {
+		t.Fatal("no DetectInfo for a delivered conn")
+	}
+	if info.Start.Before(start) || info.Decided.Sub(info.Start) < delay || info.Decided.After(time.Now()) {
+		t.Fatalf("detection from %v to %v, want at least %v after %v", info.Start, info.Decided, delay, start)
+	}
+	if info.Peeked != len(request) || info.Evaluated != 2 {
+		t.Fatalf("Peeked, Evaluated = %d, %d, want %d, 2", info.Peeked, info.Evaluated, len(request))
+	}
+
+	// only conns delivered by the dispatcher have it
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, ok := munproto.DetectInfo(server); ok {
+		t.Fatal("DetectInfo for a conn which wasn't dispatched")
+	}
+}
+
+func TestUnderlying(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := munproto.NewDefault(l)
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET / HTTP/1.1\r\n\r\n"
+	conn.Write([]byte(request))
+	delivered := acceptWithin(t, http, time.Second)
+	defer delivered.Close()
+
+	// the request is still buffered, so only force reaches the TCP conn
+	if got := munproto.Underlying(delivered, false); got != delivered {
+		t.Fatalf("Underlying() = %T with buffered bytes, want the delivered conn", got)
+	}
+	if _, ok := munproto.Underlying(delivered, true).(*net.TCPConn); !ok {
+		t.Fatalf("forced Underlying() = %T, want *net.TCPConn", munproto.Underlying(delivered, true))
+	}
+	// TLS conns are walked through NetConn
+	if _, ok := munproto.Underlying(tls.Server(delivered, &tls.Config{}), true).(*net.TCPConn); !ok {
+		t.Fatal("Underlying() of a TLS conn isn't the *net.TCPConn")
+	}
+
+	if _, err := io.ReadFull(delivered, make([]byte, len(request))); err != nil {
+		t.Fatal(err)
+	}
+	tcp, ok := munproto.Underlying(delivered, false).(*net.TCPConn)
+	if !ok {
+		t.Fatalf("Underlying() = %T after reading the buffered bytes, want *net.TCPConn", munproto.Underlying(delivered, false))
+	}
+	if err := tcp.SetNoDelay(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes to the underlying conn reach the client
+	go tcp.Write([]byte("ok"))
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ok" {
+		t.Fatalf("client read %q, %v, want ok", got, err)
+	}
+	if got := munproto.Underlying(conn, false); got != conn {
+		t.Fatal("Underlying() of a conn without wrappers isn't the conn")
+	}
+}
+
+func TestDefaultOrder(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+
+	// listeners created in the reverse of the evaluation order
+	d.Listener("http")
+	https := d.Listener("https")
+	d.Listener("socks5")
+	go d.Listen()
+	defer d.Close()
+
+	var evaluated []string
+	for _, p := range d.DebugState().Protos {
+		if p.Evaluated {
+			evaluated = append(evaluated, p.Name)
+		}
+	}
+	if strings.Join(evaluated, ",") != "socks5,https,http" {
+		t.Fatalf("evaluated protos = %v, want [socks5 https http]", evaluated)
+	}
+
+	// a TLS record header is shorter than the 7 bytes IsHTTP waits for, so if "http" was evaluated first the conn
+	// would only be delivered after the detection timeout
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("\x16\x03\x01\x00\xa5"))
+	acceptWithin(t, https, time.Second).Close()
+}
+
+// a HTTP head of n bytes
+func httpHead(n int) []byte {
+	head := []byte("GET / HTTP/1.1\r\n")
+	for i := 0; len(head) < n-2; i++ {
+		head = append(head, fmt.Sprintf("X-Pad-%d: %s\r\n", i, strings.Repeat("a", 40))...)
+	}
+	head = head[:n-4]
+	return append(head, "\r\n\r\n"...)
+}
+
+func TestGrowKeepsBuffered(t *testing.T) {
+	// larger than the grown buffer, so "header" grows it, gives up and "http" matches with the bytes of both buffers
+	head := httpHead(6004)
+
+	tests := []struct {
+		name string
+		read func(conn net.Conn) ([]byte, error)
+	}{
+		{"read", func(conn net.Conn) ([]byte, error) {
+			data := make([]byte, len(head))
+			_, err := io.ReadFull(readerOnly{conn}, data)
+			return data, err
+		}},
+		{"write to", func(conn net.Conn) ([]byte, error) {
+			var buf bytes.Buffer
+			_, err := io.CopyN(&buf, conn, int64(len(head)))
+			return buf.Bytes(), err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := munprototest.NewPipeListener()
+			d := munproto.New(pl, time.Second)
+			d.AddProto("header", munproto.HTTPHeader(4096, func(method, target string, h textproto.MIMEHeader) bool {
+				return true
+			}))
+			d.AddProto("http", munproto.IsHTTP)
+			d.Listener("header")
+			http := d.Listener("http")
+			go d.Listen()
+			defer d.Close()
+
+			conn, err := pl.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			go func() {
+				for data := head; len(data) > 0; {
+					n := 50
+					if n > len(data) {
+						n = len(data)
+					}
+					if _, err := conn.Write(data[:n]); err != nil {
+						return
+					}
+					data = data[n:]
+				}
+			}()
+
+			delivered := acceptWithin(t, http, time.Second)
+			defer delivered.Close()
+			delivered.SetReadDeadline(time.Now().Add(time.Second))
+			data, err := tt.read(delivered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, head) {
+				t.Fatalf("delivered %d bytes differing from the %d bytes sent", len(data), len(head))
+			}
+		})
+	}
+}
+
+// readerOnly hides the io.WriterTo implementation of the conn
+type readerOnly struct {
+	io.Reader
+}
+
+// the heap in use per conn while 10k conns wait for the detection of the default protos
+func BenchmarkDetectionHeap(b *testing.B) {
+	const conns = 10000
+
+	for i := 0; i < b.N; i++ {
+		pl := munprototest.NewPipeListener()
+		d := munproto.NewDefault(pl)
+		d.Listener("http")
+		var detecting int64
+		d.AddProto("count", func(r *bufio.Reader) (bool, error) {
+			atomic.AddInt64(&detecting, 1)
+			return false, nil
+		})
+		d.Listener("count")
+		d.SetOrder(append([]string{"count"}, munproto.DefaultOrder()...)...)
+		go d.Listen()
+
+		var before runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		clients := make([]net.Conn, 0, conns)
+		for j := 0; j < conns; j++ {
+			conn, err := pl.Dial()
+			if err != nil {
+				b.Fatal(err)
+			}
+			clients = append(clients, conn)
+			// "http" is evaluated last and waits for the rest of the request line
+			go conn.Write([]byte("GET"))
+		}
+		for atomic.LoadInt64(&detecting) < conns {
+			time.Sleep(time.Millisecond)
+		}
+
+		var after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapInuse-before.HeapInuse)/conns, "heap-B/conn")
+
+		for _, conn := range clients {
+			conn.Close()
+		}
+		d.Close()
+	}
+}
+
+func TestQueuedConnTimers(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  munproto.Option
+	}{
+		{"idle timeout", munproto.WithIdleTimeout(50 * time.Millisecond)},
+		{"max age", munproto.WithMaxConnAge(50 * time.Millisecond)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := munprototest.NewPipeListener()
+			d := munproto.NewDefault(pl, tt.opt)
+			http := d.Listener("http")
+			go d.Listen()
+			defer d.Close()
+
+			conn, err := pl.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+			// nobody accepts the conn for longer than the timeout
+			time.Sleep(150 * time.Millisecond)
+			delivered := acceptWithin(t, http, time.Second)
+			defer delivered.Close()
+
+			go io.ReadFull(conn, make([]byte, 2))
+			if _, err := delivered.Write([]byte("ok")); err != nil {
+				t.Fatalf("write to the delivered conn: %v", err)
+			}
+			if stats := d.Stats(); stats.IdleClosed != 0 || stats.MaxAgeClosed != 0 {
+				t.Fatal("queued conn closed by its timers")
+			}
+		})
+	}
+}
+
+func TestAcceptContextCancel(t *testing.T) {
+	const conns = 200
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	l := d.Listener("http").(munproto.ContextAcceptor)
+	go d.Listen()
+	defer d.Close()
+
+	// a cancelled Accept returns the error of the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.AcceptContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("AcceptContext() = %v, want context.Canceled", err)
+	}
+
+	go func() {
+		for i := 0; i < conns; i++ {
+			conn, err := pl.Dial()
+			if err != nil {
+				return
+			}
+			go conn.Write([]byte(fmt.Sprintf("GET /%d HTTP/1.1\r\n\r\n", i)))
+		}
+	}()
+
+	// Accepts time out while the conns are handed off, none of the conns gets lost
+	seen := map[string]bool{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seen) < conns && time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(len(seen)%5)*10*time.Microsecond)
+		conn, err := l.AcceptContext(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[line] = true
+		conn.Close()
+	}
+	if len(seen) != conns {
+		t.Fatalf("%d of %d conns accepted", len(seen), conns)
+	}
+}
+
+// the time from DispatchConn to the return of an Accept which is parked already
+func BenchmarkAcceptLatency(b *testing.B) {
+	d := munproto.New(munprototest.NewPipeListener(), time.Second)
+	d.AddProto("http", munproto.IsHTTP)
+	l := d.Listener("http")
+	defer d.Close()
+
+	var start int64
+	latencies := make(chan time.Duration)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			latencies <- time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&start))
+			conn.Close()
+		}
+	}()
+
+	data := []byte("GET / HTTP/1.1\r\n\r\n")
+	all := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		atomic.StoreInt64(&start, time.Now().UnixNano())
+		go d.DispatchConn(&memConn{data: data, chunk: len(data)})
+		all = append(all, <-latencies)
+	}
+	b.StopTimer()
+
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	b.ReportMetric(float64(all[len(all)/2]), "p50-ns")
+	b.ReportMetric(float64(all[len(all)*99/100]), "p99-ns")
+}
+
+// writerOnly hides the io.ReaderFrom implementation of the conn
+type writerOnly struct {
+	io.Writer
+}
+
+func TestConnCloseBytes(t *testing.T) {
+	// the head doesn't fit into the small detection buffer, so "header" grows it before "http" matches
+	sent := append(httpHead(6004), "body"...)
+	resp := []byte("HTTP/1.1 204 No Content\r\n\r\n")
+
+	tests := []struct {
+		name  string
+		read  func(conn net.Conn) (int64, error)
+		write func(conn net.Conn) (int64, error)
+	}{
+		{"read and write",
+			func(conn net.Conn) (int64, error) {
+				return io.Copy(io.Discard, readerOnly{conn})
+			},
+			func(conn net.Conn) (int64, error) {
+				n, err := conn.Write(resp)
+				return int64(n), err
+			}},
+		{"write to and read from",
+			func(conn net.Conn) (int64, error) {
+				var buf bytes.Buffer
+				return io.Copy(&buf, conn)
+			},
+			func(conn net.Conn) (int64, error) {
+				return io.Copy(conn, readerOnly{bytes.NewReader(resp)})
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := munproto.New(l, time.Second)
+			d.AddProto("header", munproto.HTTPHeader(4096, func(method, target string, h textproto.MIMEHeader) bool {
+				return true
+			}))
+			d.AddProto("http", munproto.IsHTTP)
+			d.Listener("header")
+			http := d.Listener("http")
+			closed := make(chan munproto.ConnCloseRecord, 1)
+			d.OnConnClose = func(rec munproto.ConnCloseRecord) {
+				closed <- rec
+			}
+			go d.Listen()
+			defer d.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			go func() {
+				conn.Write(sent)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+
+			delivered := acceptWithin(t, http, time.Second)
+			delivered.SetDeadline(time.Now().Add(time.Second))
+			if n, err := tt.read(delivered); err != nil || n != int64(len(sent)) {
+				t.Fatalf("read %d bytes, %v, want %d", n, err, len(sent))
+			}
+			if n, err := tt.write(delivered); err != nil || n != int64(len(resp)) {
+				t.Fatalf("wrote %d bytes, %v, want %d", n, err, len(resp))
+			}
+			delivered.Close()
+
+			rec := <-closed
+			if rec.BytesRead != int64(len(sent)) || rec.BytesWritten != int64(len(resp)) {
+				t.Fatalf("BytesRead, BytesWritten = %d, %d, want %d, %d", rec.BytesRead, rec.BytesWritten, len(sent), len(resp))
+			}
+			if rec.Proto != "http" || rec.ConnID != munproto.ConnID(delivered) {
+				t.Fatalf("Proto, ConnID = %s, %d, want http, %d", rec.Proto, rec.ConnID, munproto.ConnID(delivered))
+			}
+		})
+	}
+}
+
+func TestConnCloseOnce(t *testing.T) {
+	const closers = 8
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl, munproto.WithIdleTimeout(time.Millisecond))
+	http := d.Listener("http")
+	var calls int64
+	d.OnConnClose = func(rec munproto.ConnCloseRecord) {
+		atomic.AddInt64(&calls, 1)
+	}
+	go d.Listen()
+	defer d.Close()
+
+	for i := 0; i < 100; i++ {
+		conn, err := pl.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		delivered := acceptWithin(t, http, time.Second)
+
+		// the handler closes the conn from several goroutines while the idle timeout closes it too
+		var wg sync.WaitGroup
+		for j := 0; j < closers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				delivered.Close()
+			}()
+		}
+		conn.Close()
+		wg.Wait()
+	}
+
+	if n := atomic.LoadInt64(&calls); n != 100 {
+		t.Fatalf("OnConnClose called %d times for 100 conns", n)
+	}
+}
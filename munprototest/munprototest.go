@@ -0,0 +1,90 @@
+// Package munprototest provides utilities for testing detectors and code built on munproto without real sockets.
+package munprototest
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/sintanial/go-munproto"
+)
+
+// run the detector over a bufio.Reader backed by data. The data is delivered one byte per read, the same way slow
+// clients deliver it over the network, and io.EOF is returned once data is exhausted.
+func DetectBytes(detectfn func(*bufio.Reader) (bool, error), data []byte) (bool, error) {
+	return detectfn(bufio.NewReader(iotest.OneByteReader(bytes.NewReader(data))))
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// PipeListener is an in-memory net.Listener, every Dial creates a connected pair of conns with net.Pipe.
+type PipeListener struct {
+	connCh    chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		connCh: make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+}
+
+// connect to the listener, blocks until the conn is accepted or the listener is closed.
+func (self *PipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case self.connCh <- server:
+		return client, nil
+	case <-self.done:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: net.ErrClosed}
+	}
+}
+
+func (self *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.connCh:
+		return conn, nil
+	case <-self.done:
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Err: net.ErrClosed}
+	}
+}
+
+func (self *PipeListener) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.done)
+	})
+	return nil
+}
+
+func (self *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// create a default dispatcher over a PipeListener and start it, virtual listeners are created for protos in the given
+// order. The dispatcher is closed when the test finishes.
+func PipeDispatcher(t testing.TB, protos ...string) (dial func() (net.Conn, error), listeners []net.Listener) {
+	t.Helper()
+
+	pl := NewPipeListener()
+	d := munproto.NewDefault(pl)
+	for _, proto := range protos {
+		listeners = append(listeners, d.Listener(proto))
+	}
+
+	go d.Listen()
+	t.Cleanup(func() {
+		d.Close()
+	})
+
+	return pl.Dial, listeners
+}
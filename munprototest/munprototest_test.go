@@ -0,0 +1,137 @@
+package munprototest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+)
+
+func TestDetectBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		detect  func(*bufio.Reader) (bool, error)
+		data    string
+		want    bool
+		wantErr error
+	}{
+		{"http", munproto.IsHTTP, "GET / HTTP/1.1\r\n", true, nil},
+		{"http no match", munproto.IsHTTP, "SSH-2.0-OpenSSH\r\n", false, nil},
+		{"socks5", munproto.IsSOCKS5, "\x05\x01\x00", true, nil},
+		// peeks of several bytes are assembled from single byte reads
+		{"partial delivery", munproto.IsHTTP, "CONNECT example.com:443 HTTP/1.1\r\n\r\n", true, nil},
+		{"short", munproto.IsHTTP, "GET", false, io.EOF},
+		{"empty", munproto.IsSOCKS5, "", false, io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DetectBytes(tt.detect, []byte(tt.data))
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DetectBytes() = %v, %v, want %v, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// dial, send data and return the client conn
+func send(t *testing.T, dial func() (net.Conn, error), data string) net.Conn {
+	t.Helper()
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	go conn.Write([]byte(data))
+	return conn
+}
+
+func accept(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		return res.conn
+	case <-time.After(time.Second):
+		t.Fatal("no conn delivered")
+		return nil
+	}
+}
+
+func TestPipeDispatcherOrder(t *testing.T) {
+	dial, listeners := PipeDispatcher(t, "https", "socks5", "http")
+
+	send(t, dial, "\x16\x03\x01\x00\x05hello")
+	conn := accept(t, listeners[0])
+	defer conn.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "\x16\x03\x01\x00\x05" {
+		t.Fatalf("https conn starts with %q, %v", buf, err)
+	}
+
+	send(t, dial, "\x05\x01\x00")
+	accept(t, listeners[1]).Close()
+
+	send(t, dial, "GET / HTTP/1.1\r\n\r\n")
+	accept(t, listeners[2]).Close()
+}
+
+func TestPipeDispatcherUnmatched(t *testing.T) {
+	dial, _ := PipeDispatcher(t, "http")
+
+	conn := send(t, dial, "SSH-2.0-OpenSSH_9.0\r\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("unmatched conn: Read() = %v, want io.EOF", err)
+	}
+}
+
+func TestPipeDispatcherClientError(t *testing.T) {
+	dial, listeners := PipeDispatcher(t, "http")
+
+	// the client gives up during detection, the conn is dropped without being delivered
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GE"))
+	conn.Close()
+
+	send(t, dial, "GET / HTTP/1.1\r\n\r\n")
+	c := accept(t, listeners[0])
+	defer c.Close()
+	if line, _ := bufio.NewReader(c).ReadString('\n'); line != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("delivered %q", line)
+	}
+}
+
+func TestPipeListenerClose(t *testing.T) {
+	pl := NewPipeListener()
+	pl.Close()
+
+	if _, err := pl.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Dial() = %v, want net.ErrClosed", err)
+	}
+	if _, err := pl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() = %v, want net.ErrClosed", err)
+	}
+}
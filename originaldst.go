@@ -0,0 +1,57 @@
+package munproto
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+)
+
+// create a detector for AddConnProto which matches conns whose original destination is accepted by fn, e.g. when the
+// dispatcher is the target of a REDIRECT or TPROXY rule. It reads no bytes, so registered first it routes by
+// destination before the byte detectors run. The original destination is:
+//   - the destination of the PROXY header, if there is one
+//   - SO_ORIGINAL_DST of the socket on Linux, for REDIRECT
+//   - the local address of the conn otherwise, which is the original destination with TPROXY
+func OriginalDst(fn func(dst netip.AddrPort) bool) ConnDetector {
+	return func(conn net.Conn, r *bufio.Reader) (bool, error) {
+		dst, ok := OriginalDestination(conn)
+		if bufconn := bufConnOf(conn); ok && bufconn != nil {
+			bufconn.origDst = dst
+		}
+		return ok && fn(dst), nil
+	}
+}
+
+// return the original destination of conn, see OriginalDst. For conns delivered by the dispatcher the destination
+// looked up by OriginalDst is returned, ok is false if the destination isn't an IP address.
+func OriginalDestination(conn net.Conn) (dst netip.AddrPort, ok bool) {
+	bufconn := bufConnOf(conn)
+	if bufconn != nil && bufconn.origDst.IsValid() {
+		return bufconn.origDst, true
+	}
+
+	if bufconn == nil || bufconn.proxy == nil || bufconn.proxy.Destination == nil {
+		if dst, ok := sockOriginalDst(Underlying(conn, true)); ok {
+			return dst, true
+		}
+	}
+	return addrPort(conn.LocalAddr())
+}
+
+// convert addr to netip.AddrPort, IPv4-mapped IPv6 addresses are unmapped.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case nil:
+		return netip.AddrPort{}, false
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	default:
+		ap, _ = netip.ParseAddrPort(addr.String())
+	}
+
+	if !ap.IsValid() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
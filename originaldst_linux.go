@@ -0,0 +1,44 @@
+//go:build linux
+
+package munproto
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// the netfilter socket option with the destination of a conn before NAT, for both SOL_IP and SOL_IPV6
+const soOriginalDst = 80
+
+// return SO_ORIGINAL_DST of the socket of conn, ok is false if conn isn't a socket or the option isn't available,
+// e.g. without conntrack.
+func sockOriginalDst(conn net.Conn) (dst netip.AddrPort, ok bool) {
+	sc, isSocket := conn.(syscall.Conn)
+	if !isSocket {
+		return netip.AddrPort{}, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+
+	// the syscall package has no plain getsockopt, but sockaddr_in fits into the ipv6_mreq of GetsockoptIPv6Mreq and
+	// sockaddr_in6 is the start of the ip6_mtuinfo of GetsockoptIPv6MTUInfo
+	raw.Control(func(fd uintptr) {
+		if mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); err == nil {
+			sa := mreq.Multiaddr
+			ip := netip.AddrFrom4([4]byte{sa[4], sa[5], sa[6], sa[7]})
+			dst, ok = netip.AddrPortFrom(ip, uint16(sa[2])<<8|uint16(sa[3])), true
+			return
+		}
+		if info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); err == nil {
+			// the port is in network byte order
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			ip := netip.AddrFrom16(info.Addr.Addr).Unmap()
+			dst, ok = netip.AddrPortFrom(ip, uint16(port[0])<<8|uint16(port[1])), true
+		}
+	})
+	return dst, ok
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package munproto
+
+import (
+	"net"
+	"net/netip"
+)
+
+// SO_ORIGINAL_DST is Linux only, elsewhere OriginalDestination falls back to the local address.
+func sockOriginalDst(conn net.Conn) (netip.AddrPort, bool) {
+	return netip.AddrPort{}, false
+}
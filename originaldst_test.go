@@ -0,0 +1,89 @@
+package munproto_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+func TestOriginalDst(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without NAT the original destination is the address the client dialed
+	want := l.Addr().(*net.TCPAddr).AddrPort()
+
+	d := munproto.New(l, time.Second)
+	d.AddConnProto("ssh", munproto.OriginalDst(func(dst netip.AddrPort) bool { return dst == want }))
+	ssh := d.Listener("ssh")
+	go d.Listen()
+	defer d.Close()
+
+	// the client of a server speaking first sends nothing, it is routed by the destination alone
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	delivered := acceptWithin(t, ssh, time.Second)
+	defer delivered.Close()
+	if dst, ok := munproto.OriginalDestination(delivered); !ok || dst != want {
+		t.Fatalf("OriginalDestination() = %v, %v, want %v", dst, ok, want)
+	}
+}
+
+func TestOriginalDstProxy(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.ProxyProtocol = true
+	d.AddConnProto("ssh", munproto.OriginalDst(func(dst netip.AddrPort) bool { return dst.Port() == 22 }))
+	d.AddProto("http", munproto.IsHTTP)
+	ssh := d.Listener("ssh")
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	tests := []struct {
+		name string
+		dst  []byte
+		want net.Listener
+	}{
+		{"ssh", []byte{192, 0, 2, 1, 0x00, 0x16}, ssh},
+		// other destinations go through the byte detectors
+		{"http", []byte{192, 0, 2, 1, 0x00, 0x50}, http},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := pl.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// the destination of the PROXY header takes precedence over the conn
+			addrs := append([]byte{203, 0, 113, 5}, tt.dst[:4]...)
+			addrs = append(addrs, 0x30, 0x39, tt.dst[4], tt.dst[5])
+			go conn.Write(append(proxyHeader(1, 0x11, addrs), "GET / HTTP/1.1\r\n\r\n"...))
+
+			delivered := acceptWithin(t, tt.want, time.Second)
+			defer delivered.Close()
+			want := netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, 2, 1}), uint16(tt.dst[4])<<8|uint16(tt.dst[5]))
+			if dst, ok := munproto.OriginalDestination(delivered); !ok || dst != want {
+				t.Fatalf("OriginalDestination() = %v, %v, want %v", dst, ok, want)
+			}
+		})
+	}
+}
+
+func TestOriginalDestinationPipe(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if dst, ok := munproto.OriginalDestination(server); ok {
+		t.Fatalf("OriginalDestination() of a pipe = %v, want none", dst)
+	}
+}
@@ -0,0 +1,379 @@
+package munproto
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the largest datagram PacketDispatcher reads
+	maxDatagramSize = 64 * 1024
+	// datagrams queued for ReadFrom of an endpoint, further ones are dropped
+	packetQueueSize = 64
+	// DefaultFlowTTL is the flow idle timeout of NewPacketDispatcher if none is given.
+	DefaultFlowTTL = 2 * time.Minute
+)
+
+// PacketStats is a snapshot of the PacketDispatcher counters.
+type PacketStats struct {
+	// datagrams read from the PacketConn
+	Received int64
+	// datagrams queued to an endpoint
+	Delivered int64
+	// datagrams of new flows which no proto matched
+	Unmatched int64
+	// datagrams of new flows dropped because a detector panicked
+	DetectErrors int64
+	// datagrams dropped because the queue of the endpoint was full
+	Dropped int64
+	// flows currently tracked
+	Flows int64
+}
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+type packetProto struct {
+	name     string
+	detectfn func(data []byte, addr net.Addr) bool
+}
+
+// the proto of the datagrams of a source address
+type flow struct {
+	proto    string
+	lastSeen time.Time
+}
+
+// PacketDispatcher is the datagram counterpart of Dispatcher: the first datagram of a source address is matched
+// against the detectors, all datagrams of the flow are then delivered to the endpoint of the matched proto until the
+// flow is idle for the flow TTL.
+type PacketDispatcher struct {
+	mu        sync.RWMutex
+	pc        net.PacketConn
+	ttl       time.Duration
+	protos    map[string]*packetProto
+	endpoints map[string]*packetEndpoint
+	lorder    []string
+	order     []string
+	flows     map[string]*flow
+	counters  *PacketStats
+
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+
+	// ErrorHandler, if set, is called with temporary read errors (*AcceptError) and the panics of detectors
+	// (*PanicError).
+	ErrorHandler func(err error)
+}
+
+// create packet dispatcher reading from pc, flows are forgotten when idle for ttl, DefaultFlowTTL if zero.
+func NewPacketDispatcher(pc net.PacketConn, ttl time.Duration) *PacketDispatcher {
+	if ttl == 0 {
+		ttl = DefaultFlowTTL
+	}
+
+	return &PacketDispatcher{
+		pc:        pc,
+		ttl:       ttl,
+		protos:    make(map[string]*packetProto),
+		endpoints: make(map[string]*packetEndpoint),
+		flows:     make(map[string]*flow),
+		counters:  &PacketStats{},
+		done:      make(chan struct{}),
+	}
+}
+
+// register a proto, detectfn is called with the first datagram of a flow and its source address.
+func (self *PacketDispatcher) AddProto(name string, detectfn func(data []byte, addr net.Addr) bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.protos[name] = &packetProto{name: name, detectfn: detectfn}
+}
+
+// set the evaluation order of protos, same as Dispatcher.SetOrder.
+func (self *PacketDispatcher) SetOrder(protos ...string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.order = append([]string{}, protos...)
+	self.sortOrder()
+}
+
+// create endpoint for the datagrams of proto, like Dispatcher.Listener the sequence of calls defines the evaluation
+// order unless it is set by SetOrder, and repeated calls return the same endpoint. Writes go to the PacketConn.
+func (self *PacketDispatcher) Listener(proto string) net.PacketConn {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if ep, ok := self.endpoints[proto]; ok {
+		return ep
+	}
+	if _, ok := self.protos[proto]; !ok {
+		panic(fmt.Sprintf("undefined proto: %s", proto))
+	}
+
+	self.lorder = append(self.lorder, proto)
+	self.sortOrder()
+
+	ep := &packetEndpoint{
+		d:      self,
+		ch:     make(chan packet, packetQueueSize),
+		closed: self.done,
+	}
+	self.endpoints[proto] = ep
+	return ep
+}
+
+// must be called with mu held
+func (self *PacketDispatcher) sortOrder() {
+	rank := func(proto string) int {
+		for i, name := range self.order {
+			if name == proto {
+				return i
+			}
+		}
+		return len(self.order)
+	}
+
+	sort.SliceStable(self.lorder, func(i, j int) bool {
+		return rank(self.lorder[i]) < rank(self.lorder[j])
+	})
+}
+
+// read datagrams and dispatch them to the endpoints, until the PacketConn fails or Close is called.
+func (self *PacketDispatcher) Listen() error {
+	go self.expireFlows()
+
+	buf := make([]byte, maxDatagramSize)
+	var tempDelay time.Duration
+	for {
+		n, addr, err := self.pc.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+
+				if self.ErrorHandler != nil {
+					self.ErrorHandler(&AcceptError{Err: err, Delay: tempDelay})
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+
+			self.shutdown(err)
+			return err
+		}
+		tempDelay = 0
+
+		atomic.AddInt64(&self.counters.Received, 1)
+		self.dispatch(append([]byte{}, buf[:n]...), addr)
+	}
+}
+
+func (self *PacketDispatcher) dispatch(data []byte, addr net.Addr) {
+	key := addr.String()
+	now := time.Now()
+
+	self.mu.Lock()
+	f, ok := self.flows[key]
+	if ok && now.Sub(f.lastSeen) > self.ttl {
+		ok = false
+	}
+	if ok {
+		f.lastSeen = now
+	}
+	protos := make([]*packetProto, len(self.lorder))
+	for i, name := range self.lorder {
+		protos[i] = self.protos[name]
+	}
+	self.mu.Unlock()
+
+	if !ok {
+		var matched *packetProto
+		for _, p := range protos {
+			ok, err := self.detect(p, data, addr)
+			if err != nil {
+				atomic.AddInt64(&self.counters.DetectErrors, 1)
+				if self.ErrorHandler != nil {
+					self.ErrorHandler(err)
+				}
+				return
+			}
+			if ok {
+				matched = p
+				break
+			}
+		}
+		if matched == nil {
+			atomic.AddInt64(&self.counters.Unmatched, 1)
+			return
+		}
+
+		f = &flow{proto: matched.name, lastSeen: now}
+		self.mu.Lock()
+		self.flows[key] = f
+		self.mu.Unlock()
+	}
+
+	self.mu.RLock()
+	ep := self.endpoints[f.proto]
+	self.mu.RUnlock()
+
+	select {
+	case ep.ch <- packet{data, addr}:
+		atomic.AddInt64(&self.counters.Delivered, 1)
+	default:
+		atomic.AddInt64(&self.counters.Dropped, 1)
+	}
+}
+
+// run the detector of p, a panic is recovered and returned as *PanicError, so Listen keeps running for the other
+// flows.
+func (self *PacketDispatcher) detect(p *packetProto, data []byte, addr net.Addr) (ok bool, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			ok, err = false, &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return p.detectfn(data, addr), nil
+}
+
+// forget idle flows, so that the flow table doesn't grow with the number of peers ever seen.
+func (self *PacketDispatcher) expireFlows() {
+	ticker := time.NewTicker(self.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			self.mu.Lock()
+			for key, f := range self.flows {
+				if now.Sub(f.lastSeen) > self.ttl {
+					delete(self.flows, key)
+				}
+			}
+			self.mu.Unlock()
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// return a snapshot of the counters.
+func (self *PacketDispatcher) Stats() PacketStats {
+	c := self.counters
+	stats := PacketStats{
+		Received:     atomic.LoadInt64(&c.Received),
+		Delivered:    atomic.LoadInt64(&c.Delivered),
+		Unmatched:    atomic.LoadInt64(&c.Unmatched),
+		DetectErrors: atomic.LoadInt64(&c.DetectErrors),
+		Dropped:      atomic.LoadInt64(&c.Dropped),
+	}
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	stats.Flows = int64(len(self.flows))
+	return stats
+}
+
+// close the PacketConn, ReadFrom of all endpoints returns ErrDispatcherClosed.
+func (self *PacketDispatcher) Close() error {
+	self.shutdown(ErrDispatcherClosed)
+	return self.pc.Close()
+}
+
+func (self *PacketDispatcher) shutdown(err error) {
+	self.doneOnce.Do(func() {
+		if err != ErrDispatcherClosed {
+			err = &closedError{err}
+		}
+
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		self.err = err
+		close(self.done)
+	})
+}
+
+// packetEndpoint is the net.PacketConn of a proto of PacketDispatcher.
+type packetEndpoint struct {
+	d      *PacketDispatcher
+	ch     chan packet
+	closed chan struct{}
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// read the next datagram of the flows of the proto.
+func (self *packetEndpoint) ReadFrom(b []byte) (int, net.Addr, error) {
+	self.mu.Lock()
+	deadline := self.readDeadline
+	self.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-self.ch:
+		return copy(b, p.data), p.addr, nil
+	case <-self.closed:
+		self.d.mu.RLock()
+		defer self.d.mu.RUnlock()
+		return 0, nil, self.d.err
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (self *packetEndpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return self.d.pc.WriteTo(b, addr)
+}
+
+func (self *packetEndpoint) Close() error {
+	return self.d.Close()
+}
+
+func (self *packetEndpoint) LocalAddr() net.Addr {
+	return self.d.pc.LocalAddr()
+}
+
+func (self *packetEndpoint) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.SetWriteDeadline(t)
+}
+
+func (self *packetEndpoint) SetReadDeadline(t time.Time) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.readDeadline = t
+	return nil
+}
+
+// set the write deadline of the PacketConn, which is shared by all endpoints.
+func (self *packetEndpoint) SetWriteDeadline(t time.Time) error {
+	return self.d.pc.SetWriteDeadline(t)
+}
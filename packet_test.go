@@ -0,0 +1,220 @@
+package munproto_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+)
+
+// match datagrams starting with prefix
+func packetPrefix(prefix byte) func(data []byte, addr net.Addr) bool {
+	return func(data []byte, addr net.Addr) bool {
+		return len(data) > 0 && data[0] == prefix
+	}
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// create packet dispatcher with the protos "a" and "b", matching datagrams starting with A and B
+func packetDispatcher(t *testing.T, ttl time.Duration) (*munproto.PacketDispatcher, net.PacketConn, net.PacketConn, net.Addr) {
+	t.Helper()
+	pc := listenUDP(t)
+	d := munproto.NewPacketDispatcher(pc, ttl)
+	d.AddProto("a", packetPrefix('A'))
+	d.AddProto("b", packetPrefix('B'))
+	a, b := d.Listener("a"), d.Listener("b")
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, a, b, pc.LocalAddr()
+}
+
+func send(t *testing.T, client net.PacketConn, addr net.Addr, data string) {
+	t.Helper()
+	if _, err := client.WriteTo([]byte(data), addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// read a datagram from ep, fails the test if none arrives within a second
+func receive(t *testing.T, ep net.PacketConn) (string, net.Addr) {
+	t.Helper()
+	ep.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, addr, err := ep.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n]), addr
+}
+
+func waitPacketStats(t *testing.T, d *munproto.PacketDispatcher, done func(munproto.PacketStats) bool) munproto.PacketStats {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := d.Stats()
+		if done(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPacketFlowSticky(t *testing.T) {
+	_, a, b, addr := packetDispatcher(t, 0)
+	c1, c2 := listenUDP(t), listenUDP(t)
+
+	// the flow of c1 was matched to "a", so its datagrams go there regardless of their content
+	send(t, c1, addr, "A1")
+	if data, from := receive(t, a); data != "A1" || from.String() != c1.LocalAddr().String() {
+		t.Fatalf("a received %q from %v", data, from)
+	}
+	send(t, c1, addr, "B2")
+	if data, _ := receive(t, a); data != "B2" {
+		t.Fatalf("a received %q, want B2", data)
+	}
+
+	send(t, c2, addr, "B1")
+	if data, _ := receive(t, b); data != "B1" {
+		t.Fatalf("b received %q, want B1", data)
+	}
+}
+
+func TestPacketFlowTTL(t *testing.T) {
+	d, a, b, addr := packetDispatcher(t, 50*time.Millisecond)
+	client := listenUDP(t)
+
+	send(t, client, addr, "A1")
+	receive(t, a)
+
+	// the idle flow is forgotten, the next datagram is detected again
+	waitPacketStats(t, d, func(s munproto.PacketStats) bool { return s.Flows == 0 })
+	send(t, client, addr, "B2")
+	if data, _ := receive(t, b); data != "B2" {
+		t.Fatalf("b received %q, want B2", data)
+	}
+}
+
+func TestPacketQueueDrop(t *testing.T) {
+	const sent = 74
+
+	d, a, _, addr := packetDispatcher(t, 0)
+	client := listenUDP(t)
+
+	// nobody reads from "a", so the datagrams over its queue are dropped
+	for i := 0; i < sent; i++ {
+		send(t, client, addr, "A")
+	}
+	stats := waitPacketStats(t, d, func(s munproto.PacketStats) bool { return s.Delivered+s.Dropped == sent })
+	if stats.Delivered != 64 || stats.Dropped != sent-64 {
+		t.Fatalf("Delivered, Dropped = %d, %d, want 64, %d", stats.Delivered, stats.Dropped, sent-64)
+	}
+	for i := 0; i < 64; i++ {
+		receive(t, a)
+	}
+}
+
+func TestPacketDeadlines(t *testing.T) {
+	_, a, _, addr := packetDispatcher(t, 0)
+	client := listenUDP(t)
+
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := a.ReadFrom(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("ReadFrom() = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if _, _, err := a.ReadFrom(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("ReadFrom() after the deadline = %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	// replies go to the peer through the PacketConn of the dispatcher
+	send(t, client, addr, "A1")
+	_, from := receive(t, a)
+	if _, err := a.WriteTo([]byte("reply"), from); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	if n, _, err := client.ReadFrom(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("client received %q, %v, want reply", buf[:n], err)
+	}
+
+	a.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := a.WriteTo([]byte("late"), from); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("WriteTo() after the deadline = %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestPacketCloseUnblocksReaders(t *testing.T) {
+	d, a, b, _ := packetDispatcher(t, 0)
+
+	errs := make(chan error, 2)
+	for _, ep := range []net.PacketConn{a, b} {
+		go func(ep net.PacketConn) {
+			_, _, err := ep.ReadFrom(make([]byte, 64))
+			errs <- err
+		}(ep)
+	}
+	time.Sleep(10 * time.Millisecond)
+	d.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, munproto.ErrDispatcherClosed) {
+				t.Fatalf("ReadFrom() = %v, want ErrDispatcherClosed", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("ReadFrom didn't return after Close")
+		}
+	}
+}
+
+func TestPacketDetectorPanic(t *testing.T) {
+	pc := listenUDP(t)
+	d := munproto.NewPacketDispatcher(pc, 0)
+	d.AddProto("panics", func(data []byte, addr net.Addr) bool {
+		if data[0] == 'P' {
+			panic("bad datagram")
+		}
+		return false
+	})
+	d.AddProto("a", packetPrefix('A'))
+	d.Listener("panics")
+	a := d.Listener("a")
+	errs := make(chan error, 1)
+	d.ErrorHandler = func(err error) {
+		errs <- err
+	}
+	go d.Listen()
+	defer d.Close()
+
+	c1, c2 := listenUDP(t), listenUDP(t)
+	send(t, c1, pc.LocalAddr(), "P")
+	var perr *munproto.PanicError
+	if err := nextError(t, errs); !errors.As(err, &perr) {
+		t.Fatalf("error = %v, want *PanicError", err)
+	}
+
+	// Listen keeps running for the other flows
+	send(t, c2, pc.LocalAddr(), "A1")
+	if data, _ := receive(t, a); data != "A1" {
+		t.Fatalf("a received %q, want A1", data)
+	}
+	if stats := d.Stats(); stats.DetectErrors != 1 {
+		t.Fatalf("DetectErrors = %d, want 1", stats.DetectErrors)
+	}
+}
@@ -0,0 +1,216 @@
+package munproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidProxyHeader is returned when a conn doesn't start with a valid PROXY protocol v2 header.
+var ErrInvalidProxyHeader = errors.New("munproto: invalid proxy protocol header")
+
+// PROXY protocol v2 TLV types.
+const (
+	TLVTypeALPN      = 0x01
+	TLVTypeAuthority = 0x02
+	TLVTypeCRC32C    = 0x03
+	TLVTypeNoop      = 0x04
+	TLVTypeUniqueID  = 0x05
+	TLVTypeSSL       = 0x20
+	TLVTypeNetNS     = 0x30
+	TLVTypeAWS       = 0xEA
+)
+
+// subtype of the TLVTypeAWS value which carries the VPC endpoint ID
+const awsSubtypeVPCEndpointID = 0x01
+
+// TLV is a type-length-value vector of a PROXY protocol v2 header. Types unknown to the package are kept as well,
+// Value holds the raw bytes.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol v2 header.
+type ProxyHeader struct {
+	// Local is true for the LOCAL command, e.g. health checks of the proxy itself. Source and Destination are nil
+	// in this case.
+	Local       bool
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// read the PROXY protocol v2 header from r. The header is consumed, the TLVs are bounds checked against the declared
+// header length.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	data, err := r.Peek(16)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(data[:12], proxySignature) || data[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	cmd := data[12] & 0x0f
+	fam := data[13]
+	body := make([]byte, binary.BigEndian.Uint16(data[14:16]))
+	r.Discard(16)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{}
+	switch cmd {
+	case 0:
+		h.Local = true
+	case 1:
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	var addrlen int
+	switch fam >> 4 {
+	case 0x1:
+		addrlen = 12
+	case 0x2:
+		addrlen = 36
+	case 0x3:
+		addrlen = 216
+	default:
+		// unspecified family, the whole block is ignored
+		return h, nil
+	}
+	if len(body) < addrlen {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	if !h.Local {
+		h.Source, h.Destination = parseProxyAddrs(fam, body[:addrlen])
+	}
+
+	tlvs, err := parseTLVs(body[addrlen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+// write the header in the PROXY protocol v2 format. Source and Destination must be TCP addresses of the same family,
+// otherwise the addresses are sent as unspecified.
+func (self *ProxyHeader) WriteTo(w io.Writer) (int64, error) {
+	var body []byte
+
+	src, srcok := self.Source.(*net.TCPAddr)
+	dst, dstok := self.Destination.(*net.TCPAddr)
+	fam := byte(0x00)
+	if !self.Local && srcok && dstok {
+		if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+			fam = 0x11
+			body = append(append(body, src4...), dst4...)
+		} else if src4 == nil && dst4 == nil {
+			fam = 0x21
+			body = append(append(body, src.IP.To16()...), dst.IP.To16()...)
+		}
+
+		if fam != 0x00 {
+			body = append(body, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+		}
+	}
+
+	for _, tlv := range self.TLVs {
+		body = append(body, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		body = append(body, tlv.Value...)
+	}
+
+	cmd := byte(0x21)
+	if self.Local {
+		cmd = 0x20
+	}
+
+	data := append([]byte{}, proxySignature...)
+	data = append(data, cmd, fam, byte(len(body)>>8), byte(len(body)))
+	data = append(data, body...)
+
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func parseProxyAddrs(fam byte, data []byte) (src, dst net.Addr) {
+	transport := fam & 0x0f
+
+	switch fam >> 4 {
+	case 0x1, 0x2:
+		n := 4
+		if fam>>4 == 0x2 {
+			n = 16
+		}
+		srcip := net.IP(data[:n])
+		dstip := net.IP(data[n : 2*n])
+		srcport := int(binary.BigEndian.Uint16(data[2*n:]))
+		dstport := int(binary.BigEndian.Uint16(data[2*n+2:]))
+
+		if transport == 0x2 {
+			return &net.UDPAddr{IP: srcip, Port: srcport}, &net.UDPAddr{IP: dstip, Port: dstport}
+		}
+		return &net.TCPAddr{IP: srcip, Port: srcport}, &net.TCPAddr{IP: dstip, Port: dstport}
+	case 0x3:
+		network := "unix"
+		if transport == 0x2 {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: cstring(data[:108]), Net: network}, &net.UnixAddr{Name: cstring(data[108:]), Net: network}
+	}
+
+	return nil, nil
+}
+
+func cstring(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+func parseTLVs(data []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		n := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+n {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		tlvs = append(tlvs, TLV{Type: data[0], Value: data[3 : 3+n]})
+		data = data[3+n:]
+	}
+	return tlvs, nil
+}
+
+// return the TLVs of the PROXY protocol header of a conn delivered by the dispatcher, nil if there is no header.
+func ProxyTLVs(conn net.Conn) []TLV {
+	bufconn := bufConnOf(conn)
+	if bufconn == nil || bufconn.proxy == nil {
+		return nil
+	}
+	return bufconn.proxy.TLVs
+}
+
+// return the VPC endpoint ID set by AWS load balancers.
+func AWSVPCEndpointID(tlvs []TLV) (string, bool) {
+	for _, tlv := range tlvs {
+		if tlv.Type == TLVTypeAWS && len(tlv.Value) > 0 && tlv.Value[0] == awsSubtypeVPCEndpointID {
+			return string(tlv.Value[1:]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,199 @@
+package munproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// create a PROXY protocol v2 header of the command (0 LOCAL, 1 PROXY), the family byte and the body
+func proxyHeader(cmd, fam byte, body ...[]byte) []byte {
+	var data []byte
+	for _, b := range body {
+		data = append(data, b...)
+	}
+	h := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20|cmd, fam, byte(len(data)>>8), byte(len(data)))
+	return append(h, data...)
+}
+
+func tlv(typ byte, value string) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func unixPath(path string) []byte {
+	b := make([]byte, 108)
+	copy(b, path)
+	return b
+}
+
+var (
+	ipv4Addrs = []byte{203, 0, 113, 5, 192, 0, 2, 1, 0x30, 0x39, 0x01, 0xbb}
+	ipv6Addrs = append(append(net.ParseIP("2001:db8::5").To16(), net.ParseIP("2001:db8::1").To16()...), 0x30, 0x39, 0x01, 0xbb)
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		local    bool
+		src, dst string
+		tlvs     []munproto.TLV
+		err      error
+	}{
+		{name: "tcp4", data: proxyHeader(1, 0x11, ipv4Addrs), src: "203.0.113.5:12345", dst: "192.0.2.1:443"},
+		{name: "udp4", data: proxyHeader(1, 0x12, ipv4Addrs), src: "203.0.113.5:12345", dst: "192.0.2.1:443"},
+		{name: "tcp6", data: proxyHeader(1, 0x21, ipv6Addrs), src: "[2001:db8::5]:12345", dst: "[2001:db8::1]:443"},
+		{name: "unix", data: proxyHeader(1, 0x31, unixPath("/run/client.sock"), unixPath("/run/server.sock")), src: "/run/client.sock", dst: "/run/server.sock"},
+		// health checks of the proxy carry the addresses of the proxy, they are ignored
+		{name: "local", data: proxyHeader(0, 0x11, ipv4Addrs), local: true},
+		{name: "local unspec", data: proxyHeader(0, 0x00), local: true},
+		{name: "unspec", data: proxyHeader(1, 0x00, []byte("ignored"))},
+		{
+			name: "tlvs",
+			data: proxyHeader(1, 0x11, ipv4Addrs, tlv(munproto.TLVTypeAuthority, "example.com"), tlv(0xe0, "\x01\x02"), tlv(munproto.TLVTypeNoop, "")),
+			src:  "203.0.113.5:12345", dst: "192.0.2.1:443",
+			// an unknown type is kept as raw bytes
+			tlvs: []munproto.TLV{{Type: munproto.TLVTypeAuthority, Value: []byte("example.com")}, {Type: 0xe0, Value: []byte{1, 2}}, {Type: munproto.TLVTypeNoop, Value: []byte{}}},
+		},
+		// the TLV claims 16 bytes, but the header ends after 4
+		{name: "tlv past header", data: proxyHeader(1, 0x11, ipv4Addrs, []byte{0xe0, 0x00, 0x10, 'a'}), err: munproto.ErrInvalidProxyHeader},
+		{name: "truncated tlv header", data: proxyHeader(1, 0x11, ipv4Addrs, []byte{0xe0, 0x00}), err: munproto.ErrInvalidProxyHeader},
+		{name: "short addresses", data: proxyHeader(1, 0x21, ipv4Addrs), err: munproto.ErrInvalidProxyHeader},
+		{name: "bad command", data: proxyHeader(2, 0x11, ipv4Addrs), err: munproto.ErrInvalidProxyHeader},
+		{name: "v1", data: []byte("PROXY TCP4 203.0.113.5 192.0.2.1 12345 443\r\n"), err: munproto.ErrInvalidProxyHeader},
+		{name: "truncated body", data: proxyHeader(1, 0x11, ipv4Addrs)[:20], err: io.ErrUnexpectedEOF},
+		{name: "truncated signature", data: []byte("\r\n\r\n\x00"), err: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.data), bytes.NewReader([]byte("data"))))
+			h, err := munproto.ReadProxyHeader(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ReadProxyHeader() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if h.Local != tt.local {
+				t.Fatalf("Local = %v, want %v", h.Local, tt.local)
+			}
+			if got := addrString(h.Source); got != tt.src {
+				t.Fatalf("Source = %s, want %s", got, tt.src)
+			}
+			if got := addrString(h.Destination); got != tt.dst {
+				t.Fatalf("Destination = %s, want %s", got, tt.dst)
+			}
+			if !reflect.DeepEqual(h.TLVs, tt.tlvs) {
+				t.Fatalf("TLVs = %q, want %q", h.TLVs, tt.tlvs)
+			}
+
+			// only the header is consumed
+			if rest, _ := io.ReadAll(r); string(rest) != "data" {
+				t.Fatalf("read %q after the header, want %q", rest, "data")
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestProxyHeaderWriteTo(t *testing.T) {
+	tests := []*munproto.ProxyHeader{
+		{
+			Source:      &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 12345},
+			Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443},
+			TLVs:        []munproto.TLV{{Type: munproto.TLVTypeAuthority, Value: []byte("example.com")}},
+		},
+		{
+			Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::5"), Port: 12345},
+			Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		},
+		{Local: true},
+	}
+
+	for _, want := range tests {
+		var buf bytes.Buffer
+		if _, err := want.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got, err := munproto.ReadProxyHeader(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Local != want.Local || addrString(got.Source) != addrString(want.Source) ||
+			addrString(got.Destination) != addrString(want.Destination) || !reflect.DeepEqual(got.TLVs, want.TLVs) {
+			t.Fatalf("read %+v back, want %+v", got, want)
+		}
+	}
+}
+
+func TestAWSVPCEndpointID(t *testing.T) {
+	tests := []struct {
+		name string
+		tlvs []munproto.TLV
+		want string
+		ok   bool
+	}{
+		{"endpoint", []munproto.TLV{{Type: munproto.TLVTypeNoop}, {Type: munproto.TLVTypeAWS, Value: []byte("\x01vpce-08d2bf15fac5001c")}}, "vpce-08d2bf15fac5001c", true},
+		{"other subtype", []munproto.TLV{{Type: munproto.TLVTypeAWS, Value: []byte("\x02x")}}, "", false},
+		{"empty value", []munproto.TLV{{Type: munproto.TLVTypeAWS}}, "", false},
+		{"none", nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := munproto.AWSVPCEndpointID(tt.tlvs); got != tt.want || ok != tt.ok {
+				t.Fatalf("AWSVPCEndpointID() = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProxyTLVs(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.ProxyProtocol = true
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header := proxyHeader(1, 0x11, ipv4Addrs, tlv(munproto.TLVTypeAWS, "\x01vpce-08d2bf15fac5001c"))
+	go conn.Write(append(header, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"...))
+
+	delivered := acceptWithin(t, http, time.Second)
+	defer delivered.Close()
+	if got := delivered.RemoteAddr().String(); got != "203.0.113.5:12345" {
+		t.Fatalf("RemoteAddr() = %s, want the proxied source", got)
+	}
+	if got := delivered.LocalAddr().String(); got != "192.0.2.1:443" {
+		t.Fatalf("LocalAddr() = %s, want the proxied destination", got)
+	}
+	if id, ok := munproto.AWSVPCEndpointID(munproto.ProxyTLVs(delivered)); !ok || id != "vpce-08d2bf15fac5001c" {
+		t.Fatalf("AWSVPCEndpointID(ProxyTLVs()) = %q, %v", id, ok)
+	}
+
+	// the header is consumed, the handler reads the request
+	if line := readRequestLine(t, delivered); line != "GET / HTTP/1.1" {
+		t.Fatalf("read %q, want the request line", line)
+	}
+}
@@ -0,0 +1,59 @@
+package munproto
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrQueueFull is the DispatchRecord.Err of conns rejected because of WithHighWater.
+var ErrQueueFull = errors.New("munproto: accept queue full")
+
+// WithHighWater sets the high-water mark of the conns of a proto waiting for Accept. When more than n are pending
+// Dispatcher.OnHighWater is called and, if reject is true, new matches of the proto are closed until all pending
+// conns are accepted. Rejected conns are counted in Stats.QueueRejected.
+func WithHighWater(n int, reject bool) Option {
+	return func(o *options) {
+		o.highWater = n
+		o.rejectOverflow = reject
+	}
+}
+
+// enqueue a conn of p, returns false if it must be rejected. Every successful enqueue must be paired with dequeue.
+func (self *Dispatcher) enqueue(ls *listener, p *proto) bool {
+	highWater, reject := p.highWater, p.rejectOverflow
+	if highWater == 0 {
+		highWater, reject = self.highWater, self.rejectOverflow
+	}
+
+	pending := atomic.AddInt64(&ls.pending, 1)
+	if highWater > 0 && pending > int64(highWater) && atomic.CompareAndSwapInt32(&ls.overflow, 0, 1) {
+		if self.OnHighWater != nil {
+			self.OnHighWater(p.name, int(pending))
+		}
+	}
+
+	if reject && atomic.LoadInt32(&ls.overflow) == 1 {
+		ls.dequeue()
+		return false
+	}
+	ls.queued(pending)
+	return true
+}
+
+// count a conn queued for Accept, pending is the queue length including it.
+func (self *listener) queued(pending int64) {
+	atomic.AddInt64(&self.delivered, 1)
+	for {
+		max := atomic.LoadInt64(&self.maxPending)
+		if pending <= max || atomic.CompareAndSwapInt64(&self.maxPending, max, pending) {
+			return
+		}
+	}
+}
+
+// the queue drains when the last pending conn is accepted.
+func (self *listener) dequeue() {
+	if atomic.AddInt64(&self.pending, -1) == 0 {
+		atomic.StoreInt32(&self.overflow, 0)
+	}
+}
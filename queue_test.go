@@ -0,0 +1,111 @@
+package munproto_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+type highWater struct {
+	proto   string
+	pending int
+}
+
+func highWaterDispatcher(t *testing.T, opts ...munproto.Option) (*munproto.Dispatcher, *munprototest.PipeListener, chan highWater) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl, opts...)
+	calls := make(chan highWater, 16)
+	d.OnHighWater = func(proto string, pending int) {
+		calls <- highWater{proto, pending}
+	}
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, pl, calls
+}
+
+func waitQueueRejected(t *testing.T, d *munproto.Dispatcher, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for d.Stats().QueueRejected < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("QueueRejected = %d, want %d", d.Stats().QueueRejected, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func noHighWater(t *testing.T, calls chan highWater) {
+	t.Helper()
+	select {
+	case c := <-calls:
+		t.Fatalf("unexpected OnHighWater(%q, %d)", c.proto, c.pending)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestHighWater(t *testing.T) {
+	d, pl, calls := highWaterDispatcher(t, munproto.WithHighWater(2, false))
+	http := d.Listener("http")
+	sp := http.(munproto.StatsProvider)
+
+	for i := 1; i <= 4; i++ {
+		dialHTTP(t, pl)
+		waitListenerStats(t, sp, func(s munproto.ListenerStats) bool { return s.Pending == int64(i) })
+	}
+	// called once when the mark is exceeded, not for every conn over it
+	if c := <-calls; c.proto != "http" || c.pending != 3 {
+		t.Fatalf("OnHighWater(%q, %d), want http, 3", c.proto, c.pending)
+	}
+	noHighWater(t, calls)
+
+	// without reject all conns are delivered
+	for i := 0; i < 4; i++ {
+		acceptWithin(t, http, time.Second).Close()
+	}
+	waitListenerStats(t, sp, func(s munproto.ListenerStats) bool { return s.Pending == 0 })
+	if s := sp.Stats(); s.MaxPending != 4 || d.Stats().QueueRejected != 0 {
+		t.Fatalf("MaxPending, QueueRejected = %d, %d, want 4, 0", s.MaxPending, d.Stats().QueueRejected)
+	}
+
+	// the queue drained, so the hook is called again
+	for i := 1; i <= 3; i++ {
+		dialHTTP(t, pl)
+		waitListenerStats(t, sp, func(s munproto.ListenerStats) bool { return s.Pending == int64(i) })
+	}
+	if c := <-calls; c.pending != 3 {
+		t.Fatalf("OnHighWater(%q, %d) after the drain, want 3", c.proto, c.pending)
+	}
+}
+
+func TestHighWaterReject(t *testing.T) {
+	d, pl, calls := highWaterDispatcher(t, munproto.WithHighWater(1, true))
+	http := d.Listener("http")
+	sp := http.(munproto.StatsProvider)
+
+	dialHTTP(t, pl)
+	waitListenerStats(t, sp, func(s munproto.ListenerStats) bool { return s.Pending == 1 })
+	noHighWater(t, calls)
+
+	// the second conn exceeds the mark and is rejected, and so is every conn until the queue drained
+	dialHTTP(t, pl)
+	waitQueueRejected(t, d, 1)
+	if c := <-calls; c.proto != "http" || c.pending != 2 {
+		t.Fatalf("OnHighWater(%q, %d), want http, 2", c.proto, c.pending)
+	}
+	dialHTTP(t, pl)
+	waitQueueRejected(t, d, 2)
+
+	acceptWithin(t, http, time.Second).Close()
+	waitListenerStats(t, sp, func(s munproto.ListenerStats) bool { return s.Pending == 0 })
+
+	// drained, new conns are queued again
+	dialHTTP(t, pl)
+	acceptWithin(t, http, time.Second).Close()
+	if n := d.Stats().QueueRejected; n != 2 {
+		t.Fatalf("QueueRejected = %d, want 2", n)
+	}
+	noHighWater(t, calls)
+}
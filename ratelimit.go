@@ -0,0 +1,87 @@
+package munproto
+
+import (
+	"sync"
+	"time"
+)
+
+// the largest chunk read or written at once by throttled conns
+const maxThrottleChunk = 32 * 1024
+
+// WithRateLimit limits the aggregate bandwidth of all delivered conns of a proto, in bytes per second, separately for
+// bytes read from the clients and written to them. Zero means no limit. When passed to New every proto gets its own
+// limit.
+func WithRateLimit(readBytesPerSec, writeBytesPerSec int64) Option {
+	return func(o *options) {
+		o.readRate = readBytesPerSec
+		o.writeRate = writeBytesPerSec
+	}
+}
+
+// bucket is a token bucket shared by the conns of a proto, it also measures the throughput.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	window      time.Time
+	windowBytes int64
+	throughput  float64
+}
+
+func newBucket(rate int64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: now, window: now}
+}
+
+// take n tokens, blocking until they are available. Tokens may be taken in advance, then the next callers wait.
+func (self *bucket) wait(n int) {
+	self.mu.Lock()
+	now := time.Now()
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	if self.tokens > self.rate {
+		self.tokens = self.rate
+	}
+	self.last = now
+	self.tokens -= float64(n)
+	tokens := self.tokens
+
+	self.measure(now)
+	self.windowBytes += int64(n)
+	self.mu.Unlock()
+
+	if tokens < 0 {
+		time.Sleep(time.Duration(-tokens / self.rate * float64(time.Second)))
+	}
+}
+
+// must be called with mu held
+func (self *bucket) measure(now time.Time) {
+	if elapsed := now.Sub(self.window); elapsed >= time.Second {
+		self.throughput = float64(self.windowBytes) / elapsed.Seconds()
+		self.window = now
+		self.windowBytes = 0
+	}
+}
+
+// return the throughput in bytes per second, measured over the last complete window.
+func (self *bucket) rateNow() float64 {
+	if self == nil {
+		return 0
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	now := time.Now()
+	self.measure(now)
+	if now.Sub(self.window) >= 2*time.Second {
+		return 0
+	}
+	return self.throughput
+}
@@ -0,0 +1,88 @@
+package munproto_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+const rateLimit = 32 * 1024
+
+// create a dispatcher with the rate limits for http and deliver a conn to it
+func throttled(t *testing.T, read, write int64) (*munproto.Dispatcher, net.Conn, net.Conn) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.AddProto("http", munproto.IsHTTP, munproto.WithRateLimit(read, write))
+	http := d.Listener("http")
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	delivered := acceptWithin(t, http, time.Second)
+	t.Cleanup(func() { delivered.Close() })
+	if _, err := io.ReadFull(delivered, make([]byte, len("GET / HTTP/1.1\r\n\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	return d, conn, delivered
+}
+
+// copy n bytes from w to r and return how long it took
+func transfer(t *testing.T, w io.Writer, r io.Reader, n int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	go w.Write(make([]byte, n))
+	if _, err := io.ReadFull(r, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	_, conn, delivered := throttled(t, rateLimit, rateLimit)
+
+	// the bucket starts full, the request took a few tokens of the read direction only
+	if elapsed := transfer(t, delivered, conn, rateLimit); elapsed > 200*time.Millisecond {
+		t.Fatalf("writing the burst took %v", elapsed)
+	}
+	if elapsed := transfer(t, conn, delivered, rateLimit/2); elapsed > 200*time.Millisecond {
+		t.Fatalf("reading within the burst took %v", elapsed)
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	d, conn, delivered := throttled(t, 0, rateLimit)
+
+	// the burst and half a second worth of tokens
+	start := time.Now()
+	if elapsed := transfer(t, delivered, conn, rateLimit*3/2); elapsed < 350*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Fatalf("writing 1.5s worth of bytes took %v, want about 0.5s", elapsed)
+	}
+	// the bucket is empty, so the next bytes wait for the refill
+	if elapsed := transfer(t, delivered, conn, rateLimit/4); elapsed < 150*time.Millisecond {
+		t.Fatalf("writing after the burst took only %v", elapsed)
+	}
+	// reads are unlimited
+	if elapsed := transfer(t, conn, delivered, 4*rateLimit); elapsed > 200*time.Millisecond {
+		t.Fatalf("unlimited reads took %v", elapsed)
+	}
+
+	// the throughput is measured over whole seconds
+	time.Sleep(time.Until(start.Add(1100 * time.Millisecond)))
+	stats := d.Stats().Protos["http"]
+	if stats.WriteRate <= 0 || stats.WriteRate > 2*rateLimit {
+		t.Fatalf("WriteRate = %.0f, want up to %d", stats.WriteRate, 2*rateLimit)
+	}
+	if stats.ReadRate != 0 {
+		t.Fatalf("ReadRate = %.0f without a read limit", stats.ReadRate)
+	}
+}
@@ -0,0 +1,132 @@
+package munproto
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// the default number of records kept for RecentErrors, see WithRecentErrors
+	defaultRecentErrors = 128
+	// the number of peeked bytes kept in ErrorRecord.Data
+	recentErrorBytes = 32
+)
+
+// ErrorRecord describes a conn which failed detection, matched no proto or was rejected.
+type ErrorRecord struct {
+	Time       time.Time
+	ConnID     uint64
+	RemoteAddr net.Addr
+	// the proto which was evaluated or rejected the conn, empty if no proto matched
+	Proto string
+	// the detection error, ErrNoMatch, ErrAccessDenied or ErrQueueFull
+	Err error
+	// the first peeked bytes of the conn
+	Data []byte
+}
+
+// encode RemoteAddr and Err as strings and Data as hex.
+func (self ErrorRecord) MarshalJSON() ([]byte, error) {
+	var addr string
+	if self.RemoteAddr != nil {
+		addr = self.RemoteAddr.String()
+	}
+	return json.Marshal(struct {
+		Time       time.Time
+		ConnID     uint64
+		RemoteAddr string
+		Proto      string
+		Err        string
+		Data       string
+	}{self.Time, self.ConnID, addr, self.Proto, self.Err.Error(), hex.EncodeToString(self.Data)})
+}
+
+// WithRecentErrors sets the number of records kept for RecentErrors, 128 by default. Zero or less disables them, e.g.
+// when the peer data they contain must not be retained. Only applies when passed to New.
+func WithRecentErrors(n int) Option {
+	return func(o *options) {
+		if n <= 0 {
+			n = -1
+		}
+		o.recentErrors = n
+	}
+}
+
+// return the recent errors, oldest first. It is nil if they are disabled by WithRecentErrors.
+func (self *Dispatcher) RecentErrors() []ErrorRecord {
+	if self.recent == nil {
+		return nil
+	}
+	return self.recent.list()
+}
+
+func (self *Dispatcher) recordError(bufconn *bufConn, proto string, err error) {
+	if self.recent == nil {
+		return
+	}
+
+	var derr *DetectionError
+	if proto == "" && errors.As(err, &derr) {
+		proto = derr.Proto
+	}
+
+	n := bufconn.r.Buffered()
+	if n > recentErrorBytes {
+		n = recentErrorBytes
+	}
+	data, _ := bufconn.r.Peek(n)
+
+	self.recent.add(ErrorRecord{
+		Time:       time.Now(),
+		ConnID:     bufconn.id,
+		RemoteAddr: bufconn.RemoteAddr(),
+		Proto:      proto,
+		Err:        err,
+		Data:       append([]byte{}, data...),
+	})
+}
+
+// errorRing keeps the last records added.
+type errorRing struct {
+	mu      sync.Mutex
+	records []ErrorRecord
+	next    int
+	full    bool
+}
+
+// create ring of size records, nil if size is negative.
+func newErrorRing(size int) *errorRing {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = defaultRecentErrors
+	}
+	return &errorRing{records: make([]ErrorRecord, size)}
+}
+
+func (self *errorRing) add(rec ErrorRecord) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.records[self.next] = rec
+	self.next++
+	if self.next == len(self.records) {
+		self.next = 0
+		self.full = true
+	}
+}
+
+func (self *errorRing) list() []ErrorRecord {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if !self.full {
+		return append([]ErrorRecord{}, self.records[:self.next]...)
+	}
+	return append(append([]ErrorRecord{}, self.records[self.next:]...), self.records[:self.next]...)
+}
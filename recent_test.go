@@ -0,0 +1,116 @@
+package munproto
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// return the conn ids of records
+func connIDs(records []ErrorRecord) []uint64 {
+	ids := make([]uint64, len(records))
+	for i, rec := range records {
+		ids[i] = rec.ConnID
+	}
+	return ids
+}
+
+func TestErrorRingWraparound(t *testing.T) {
+	tests := []struct {
+		adds int
+		want []uint64
+	}{
+		{0, []uint64{}},
+		{2, []uint64{1, 2}},
+		{3, []uint64{1, 2, 3}},
+		{4, []uint64{2, 3, 4}},
+		{6, []uint64{4, 5, 6}},
+		{7, []uint64{5, 6, 7}},
+	}
+
+	for _, tt := range tests {
+		ring := newErrorRing(3)
+		for i := 1; i <= tt.adds; i++ {
+			ring.add(ErrorRecord{ConnID: uint64(i)})
+		}
+		if got := connIDs(ring.list()); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%d adds: list() = %v, want %v", tt.adds, got, tt.want)
+		}
+	}
+
+	if newErrorRing(-1) != nil {
+		t.Error("newErrorRing(-1) isn't nil")
+	}
+	if n := len(newErrorRing(0).records); n != defaultRecentErrors {
+		t.Errorf("newErrorRing(0) keeps %d records, want %d", n, defaultRecentErrors)
+	}
+}
+
+func TestErrorRingConcurrent(t *testing.T) {
+	const (
+		size    = 16
+		writers = 8
+		adds    = 1000
+	)
+
+	ring := newErrorRing(size)
+	// the records of each writer must appear in the order it added them
+	ordered := func(records []ErrorRecord) error {
+		last := map[uint64]uint64{}
+		for _, rec := range records {
+			writer, seq := rec.ConnID>>32, rec.ConnID&0xffffffff
+			if seq <= last[writer] {
+				return fmt.Errorf("record %d of writer %d after %d", seq, writer, last[writer])
+			}
+			last[writer] = seq
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for w := uint64(0); w < writers; w++ {
+		wg.Add(1)
+		go func(w uint64) {
+			defer wg.Done()
+			for seq := uint64(1); seq <= adds; seq++ {
+				ring.add(ErrorRecord{ConnID: w<<32 | seq})
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				readErr <- nil
+				return
+			default:
+			}
+			records := ring.list()
+			if len(records) > size {
+				readErr <- fmt.Errorf("list() returned %d records, want at most %d", len(records), size)
+				return
+			}
+			if err := ordered(records); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+
+	records := ring.list()
+	if len(records) != size {
+		t.Fatalf("list() returned %d records, want %d", len(records), size)
+	}
+	if err := ordered(records); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,159 @@
+package munproto
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// the write deadline of reject responses, so a dead peer can't block the dispatch
+const rejectWriteTimeout = time.Second
+
+// RejectResponder writes a response to a rejected conn before it is closed, peeked are the bytes read during
+// detection.
+type RejectResponder func(conn net.Conn, peeked []byte)
+
+// set the responder for the rejected conns of proto: conns denied by the policy of Restrict or by WithHighWater. With
+// UnmatchedProto it is called for conns no proto matched, unless they are forwarded by ForwardUnmatched. A nil fn
+// removes the responder. Responses are counted in Stats.RejectResponses, responses which failed to write in
+// Stats.RejectFailures.
+func (self *Dispatcher) SetRejectResponder(proto string, fn RejectResponder) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, ok := self.protos[proto]; !ok && proto != UnmatchedProto {
+		return fmt.Errorf("munproto: undefined proto: %s", proto)
+	}
+
+	if fn == nil {
+		delete(self.rejecters, proto)
+	} else {
+		self.rejecters[proto] = fn
+	}
+	return nil
+}
+
+// WithGracefulReject makes rejected and unmatched conns close gracefully: after the reject response the write side is
+// shut down and up to maxDrain unread bytes are discarded, for at most timeout, before the conn is closed. Closing a
+// TCP conn with unread bytes sends a RST instead of a FIN, which clients report as a connection reset. Only applies
+// when passed to New.
+func WithGracefulReject(maxDrain int64, timeout time.Duration) Option {
+	return func(o *options) {
+		o.rejectDrain = maxDrain
+		o.rejectTimeout = timeout
+	}
+}
+
+// respond to and close a rejected conn of proto.
+func (self *Dispatcher) reject(bufconn *bufConn, proto string) {
+	self.respondReject(bufconn, proto)
+
+	if self.rejectDrain > 0 {
+		bufconn.CloseWrite()
+		bufconn.Conn.SetReadDeadline(time.Now().Add(self.rejectTimeout))
+		io.CopyN(io.Discard, bufconn.Conn, self.rejectDrain)
+	}
+	bufconn.Close()
+}
+
+// write the reject response of proto, if there is a responder.
+func (self *Dispatcher) respondReject(bufconn *bufConn, proto string) {
+	self.mu.RLock()
+	fn := self.rejecters[proto]
+	self.mu.RUnlock()
+
+	if fn == nil {
+		return
+	}
+
+	peeked, _ := bufconn.r.Peek(bufconn.r.Buffered())
+	bufconn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	conn := &rejectConn{Conn: bufconn}
+	fn(conn, peeked)
+
+	switch {
+	case conn.err != nil:
+		atomic.AddInt64(&self.counters.RejectFailures, 1)
+	case conn.written > 0:
+		atomic.AddInt64(&self.counters.RejectResponses, 1)
+	}
+}
+
+// rejectConn records the outcome of the writes of a RejectResponder.
+type rejectConn struct {
+	net.Conn
+	written int
+	err     error
+}
+
+func (self *rejectConn) Write(b []byte) (int, error) {
+	n, err := self.Conn.Write(b)
+	self.written += n
+	if err != nil && self.err == nil {
+		self.err = err
+	}
+	return n, err
+}
+
+func (self *rejectConn) NetConn() net.Conn {
+	return self.Conn
+}
+
+// create responder which writes a response with the status code, e.g. http.StatusMisdirectedRequest or
+// http.StatusBadRequest, and no body.
+func HTTPRejectResponder(code int) RejectResponder {
+	resp := []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code)))
+	return func(conn net.Conn, peeked []byte) {
+		conn.Write(resp)
+	}
+}
+
+// create responder which replies to the SOCKS5 greeting that no offered auth method is acceptable.
+func SOCKS5RejectResponder() RejectResponder {
+	return func(conn net.Conn, peeked []byte) {
+		conn.Write([]byte{0x05, 0xFF})
+	}
+}
+
+// create responder which sends a fatal unrecognized_name TLS alert.
+func TLSRejectResponder() RejectResponder {
+	return func(conn net.Conn, peeked []byte) {
+		conn.Write([]byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x70})
+	}
+}
+
+// create responder which chooses the response by the peeked bytes: SOCKS5 greetings and TLS records get the
+// responses of SOCKS5RejectResponder and TLSRejectResponder, conns which look like HTTP a 400 response, other conns
+// nothing. Intended for UnmatchedProto.
+func AutoRejectResponder() RejectResponder {
+	socks5fn := SOCKS5RejectResponder()
+	tlsfn := TLSRejectResponder()
+	httpfn := HTTPRejectResponder(http.StatusBadRequest)
+	return func(conn net.Conn, peeked []byte) {
+		switch {
+		case len(peeked) == 0:
+		case peeked[0] == 0x05:
+			socks5fn(conn, peeked)
+		case peeked[0] == recordTypeHandshake:
+			tlsfn(conn, peeked)
+		case looksLikeHTTP(peeked):
+			httpfn(conn, peeked)
+		}
+	}
+}
+
+// report whether data starts with an uppercase token followed by a space, like an HTTP request line.
+func looksLikeHTTP(data []byte) bool {
+	for i, c := range data {
+		if c == ' ' {
+			return i > 0
+		}
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return false
+}
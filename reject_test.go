@@ -0,0 +1,124 @@
+package munproto_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+func rejectDispatcher(t *testing.T) (*munproto.Dispatcher, *munprototest.PipeListener) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	d.Listener("http")
+	if err := d.SetRejectResponder(munproto.UnmatchedProto, munproto.AutoRejectResponder()); err != nil {
+		t.Fatal(err)
+	}
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, pl
+}
+
+func TestRejectResponses(t *testing.T) {
+	d, pl := rejectDispatcher(t)
+
+	// a HTTP-looking request no proto matched gets a 400 response
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("BREW /pot HTCPCP/1.0\r\n\r\n"))
+
+	// the conn is closed after the response is counted
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(resp), "HTTP/1.1 400 ") {
+		t.Fatalf("response = %q, want a 400 response", resp)
+	}
+
+	// no response for conns the responder doesn't recognize
+	conn, err = pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("\x00\x01\x02\x03\x04\x05\x06\x07"))
+	if resp, _ := io.ReadAll(conn); len(resp) != 0 {
+		t.Fatalf("response = %q, want none", resp)
+	}
+
+	if stats := d.Stats(); stats.RejectResponses != 1 || stats.RejectFailures != 0 {
+		t.Fatalf("RejectResponses = %d, RejectFailures = %d, want 1, 0", stats.RejectResponses, stats.RejectFailures)
+	}
+}
+
+func TestRejectFailures(t *testing.T) {
+	d, pl := rejectDispatcher(t)
+
+	// the client is gone by the time the response is written
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("BREW /pot HTCPCP/1.0\r\n\r\n"))
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for d.Stats().RejectFailures == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := d.Stats(); stats.RejectResponses != 0 || stats.RejectFailures != 1 {
+		t.Fatalf("RejectResponses = %d, RejectFailures = %d, want 0, 1", stats.RejectResponses, stats.RejectFailures)
+	}
+}
+
+func TestGracefulReject(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []munproto.Option
+		want error
+	}{
+		{"graceful", []munproto.Option{munproto.WithGracefulReject(1<<20, 200*time.Millisecond)}, nil},
+		{"not graceful", nil, syscall.ECONNRESET},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := munproto.New(l, time.Second, tt.opts...)
+			d.AddProto("http", munproto.IsHTTP)
+			d.Listener("http")
+			go d.Listen()
+			defer d.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// no proto matches, and most of the bytes are still unread when the conn is closed
+			data := append([]byte("\x00\x01\x02\x03\x04\x05\x06\x07"), make([]byte, 16<<10)...)
+			if _, err := conn.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadAll(conn); !errors.Is(err, tt.want) {
+				t.Fatalf("read = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package munproto
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// ErrProtoRemoved is returned by Accept of the listeners of protos removed by ReplaceProtos.
+var ErrProtoRemoved = fmt.Errorf("munproto: proto removed: %w", net.ErrClosed)
+
+// ProtoSpec describes a proto for ReplaceProtos.
+type ProtoSpec struct {
+	Name   string
+	Detect func(*bufio.Reader) (bool, error)
+	// used instead of Detect if set, like with AddConnProto
+	DetectConn ConnDetector
+	// position in the evaluation order, specs with equal Order keep their order in the slice
+	Order   int
+	Options []Option
+}
+
+// replace all protos with specs in one step: conns dispatched afterwards are detected with the new set, in the order
+// of the specs, while running detections finish with the old one. Listeners and forwards of protos present in both
+// sets stay untouched, as do their Restrict policies, Trace tracers, RequireTLS, the ProtoInfo of AddProtoInfo and
+// the detection counters. Listeners of removed protos are closed with ErrProtoRemoved and their forwards are dropped.
+// The specs are validated first, on error nothing is changed.
+func (self *Dispatcher) ReplaceProtos(specs []ProtoSpec) error {
+	protos := make(map[string]*proto, len(specs))
+	for _, spec := range specs {
+		if spec.Name == "" || spec.Name == UnmatchedProto {
+			return fmt.Errorf("munproto: invalid proto name: %q", spec.Name)
+		}
+		if spec.Detect == nil && spec.DetectConn == nil {
+			return fmt.Errorf("munproto: no detector for proto: %s", spec.Name)
+		}
+		if _, ok := protos[spec.Name]; ok {
+			return fmt.Errorf("munproto: duplicate proto: %s", spec.Name)
+		}
+
+		p := &proto{name: spec.Name, detectfn: spec.Detect, connfn: spec.DetectConn}
+		self.initProto(p, spec.Options)
+		protos[spec.Name] = p
+	}
+
+	sorted := append([]ProtoSpec{}, specs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Order < sorted[j].Order
+	})
+	order := make([]string, len(sorted))
+	for i, spec := range sorted {
+		order[i] = spec.Name
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for name, old := range self.protos {
+		if p, ok := protos[name]; ok {
+			p.policy, p.tracer, p.requireTLS = old.policy, old.tracer, old.requireTLS
+			p.info = old.info
+			p.info.Detect = p.detectfn
+			p.counts = old.counts
+			continue
+		}
+
+		if l, ok := self.listeners[name]; ok {
+			l.close(ErrProtoRemoved)
+			delete(self.listeners, name)
+		}
+		delete(self.forwards, name)
+		delete(self.rejecters, name)
+	}
+
+	lorder := make([]string, 0, len(self.lorder))
+	for _, name := range self.lorder {
+		if _, ok := protos[name]; ok {
+			lorder = append(lorder, name)
+		}
+	}
+
+	self.protos = protos
+	self.order = order
+	self.lorder = lorder
+	self.sortOrder()
+	return nil
+}
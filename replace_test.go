@@ -0,0 +1,310 @@
+package munproto_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// return the descriptions of the protos in the debug state by name
+func descriptions(d *munproto.Dispatcher) map[string]string {
+	desc := map[string]string{}
+	for _, p := range d.DebugState().Protos {
+		desc[p.Name] = p.Description
+	}
+	return desc
+}
+
+func TestReplaceProtosKeepsInfo(t *testing.T) {
+	d := munproto.NewDefault(munprototest.NewPipeListener())
+	before := descriptions(d)
+	if before["http"] == "" {
+		t.Fatal("default proto without description")
+	}
+
+	err := d.ReplaceProtos([]munproto.ProtoSpec{
+		{Name: "https", Detect: munproto.IsHTTPS},
+		{Name: "http", Detect: munproto.IsHTTP},
+		{Name: "custom", Detect: munproto.IsOpenVPN},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := descriptions(d)
+	for _, name := range []string{"https", "http"} {
+		if after[name] != before[name] {
+			t.Errorf("description of %s = %q, want %q", name, after[name], before[name])
+		}
+	}
+	if desc, ok := after["custom"]; !ok || desc != "" {
+		t.Errorf("description of custom = %q, %v, want empty", desc, ok)
+	}
+	if _, ok := after["socks5"]; ok {
+		t.Error("removed proto socks5 still registered")
+	}
+}
+
+func TestReplaceProtos(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	socks5 := d.Listener("socks5")
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	err := d.ReplaceProtos([]munproto.ProtoSpec{
+		{Name: "http", Detect: munproto.IsHTTP, Order: 1},
+		{Name: "socks4", Detect: munproto.IsSOCKS4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// listeners of removed protos are closed, kept ones go on delivering
+	if _, err := socks5.Accept(); !errors.Is(err, munproto.ErrProtoRemoved) || !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept of a removed proto = %v, want ErrProtoRemoved", err)
+	}
+	dialHTTP(t, pl)
+	acceptWithin(t, http, time.Second).Close()
+
+	// an invalid set changes nothing
+	err = d.ReplaceProtos([]munproto.ProtoSpec{
+		{Name: "socks4", Detect: munproto.IsSOCKS4},
+		{Name: "socks4", Detect: munproto.IsSOCKS5},
+	})
+	if err == nil {
+		t.Fatal("ReplaceProtos with duplicate protos didn't fail")
+	}
+	dialHTTP(t, pl)
+	acceptWithin(t, http, time.Second).Close()
+}
+
+// accept conns from l and close them until l is closed, done is closed then
+func closeAccepted(l net.Listener) (done chan struct{}) {
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return done
+}
+
+func TestReplaceProtosUnderLoad(t *testing.T) {
+	const clients = 8
+
+	before := runtime.NumGoroutine()
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	specs := []munproto.ProtoSpec{
+		{Name: "first", Detect: munproto.IsHTTP},
+		{Name: "second", Detect: munproto.IsHTTP},
+	}
+	if err := d.ReplaceProtos(specs); err != nil {
+		t.Fatal(err)
+	}
+	first := closeAccepted(d.Listener("first"))
+	second := closeAccepted(d.Listener("second"))
+	go d.Listen()
+
+	// the clients wait until their conn was closed, a conn stuck in the hand-off to a removed listener stalls them
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var served int64
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				conn, err := pl.Dial()
+				if err != nil {
+					return
+				}
+				go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+				io.Copy(io.Discard, conn)
+				conn.Close()
+				atomic.AddInt64(&served, 1)
+			}
+		}()
+	}
+
+	// remove "first" and add it back, the conns decided for it fall through to "second"
+	for i := 0; i < 200; i++ {
+		if err := d.ReplaceProtos(specs[1:]); err != nil {
+			t.Fatal(err)
+		}
+		<-first
+		if err := d.ReplaceProtos(specs); err != nil {
+			t.Fatal(err)
+		}
+		first = closeAccepted(d.Listener("first"))
+		time.Sleep(100 * time.Microsecond)
+	}
+	close(stop)
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("clients stalled, conns stuck in the hand-off")
+	}
+	if atomic.LoadInt64(&served) == 0 {
+		t.Fatal("no conns served")
+	}
+
+	d.Close()
+	<-first
+	<-second
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines after the dispatcher closed, %d before", n, before)
+	}
+}
+
+// record the snapshots each conn was evaluated with by the tags of its detectors
+type snapshotLog struct {
+	mu   sync.Mutex
+	tags map[uint64][]string
+}
+
+func (self *snapshotLog) detector(tag string) munproto.ConnDetector {
+	return func(conn net.Conn, r *bufio.Reader) (bool, error) {
+		id := munproto.ConnID(conn)
+		self.mu.Lock()
+		self.tags[id] = append(self.tags[id], tag)
+		self.mu.Unlock()
+		// let ReplaceProtos run between the detectors of a conn
+		runtime.Gosched()
+		return false, nil
+	}
+}
+
+func (self *snapshotLog) specs(snapshot string) []munproto.ProtoSpec {
+	return []munproto.ProtoSpec{
+		{Name: "first", DetectConn: self.detector(snapshot + " first")},
+		{Name: "second", DetectConn: self.detector(snapshot + " second")},
+	}
+}
+
+func TestReplaceProtosSnapshots(t *testing.T) {
+	const (
+		conns   = 10000
+		workers = 8
+	)
+
+	log := &snapshotLog{tags: map[uint64][]string{}}
+	d := munproto.New(munprototest.NewPipeListener(), time.Second)
+	if err := d.ReplaceProtos(log.specs("a")); err != nil {
+		t.Fatal(err)
+	}
+	d.Listener("first")
+	d.Listener("second")
+	defer d.Close()
+
+	// the dispatching starts once the first snapshot was replaced
+	started, stop := make(chan struct{}), make(chan struct{})
+	replaced := make(chan error, 1)
+	go func() {
+		for i := 1; ; i++ {
+			if err := d.ReplaceProtos(log.specs([]string{"a", "b"}[i%2])); err != nil {
+				replaced <- err
+				return
+			}
+			if i == 1 {
+				close(started)
+			}
+			runtime.Gosched()
+			select {
+			case <-stop:
+				replaced <- nil
+				return
+			default:
+			}
+		}
+	}()
+	<-started
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < conns/workers; j++ {
+				d.DispatchConn(&memConn{data: []byte("x"), chunk: 1})
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	if err := <-replaced; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(log.tags) != conns {
+		t.Fatalf("%d conns evaluated, want %d", len(log.tags), conns)
+	}
+	snapshots := map[string]int{}
+	for id, tags := range log.tags {
+		got := strings.Join(tags, ",")
+		if got != "a first,a second" && got != "b first,b second" {
+			t.Fatalf("conn %d evaluated with %s", id, got)
+		}
+		snapshots[got]++
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("the snapshot wasn't replaced while dispatching: %v", snapshots)
+	}
+}
+
+func TestReplaceProtosInvalid(t *testing.T) {
+	d := munproto.NewDefault(munprototest.NewPipeListener())
+	generation := d.DebugState().Generation
+	before := descriptions(d)
+
+	err := d.ReplaceProtos([]munproto.ProtoSpec{
+		{Name: "http", Detect: munproto.IsHTTP},
+		{Name: "http", Detect: munproto.IsHTTPS},
+	})
+	if err == nil {
+		t.Fatal("ReplaceProtos with duplicate protos didn't fail")
+	}
+
+	if got := d.DebugState().Generation; got != generation {
+		t.Fatalf("generation = %d after a failed ReplaceProtos, want %d", got, generation)
+	}
+	if after := descriptions(d); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Fatalf("protos = %v after a failed ReplaceProtos, want %v", after, before)
+	}
+}
@@ -0,0 +1,132 @@
+package munproto
+
+import (
+	"bufio"
+)
+
+// Result is the decision of a DataDetector.
+type Result int
+
+const (
+	NoMatch Result = iota
+	Match
+	// the detector can't decide with the bytes available yet
+	NeedMore
+)
+
+// DataDetector decides on the bytes a client has sent so far, without blocking. With NeedMore it returns the minimum
+// number of additional bytes it needs to decide.
+type DataDetector func(data []byte) (res Result, need int)
+
+// run the detector over r, it can be passed to AddProto. The bytes already buffered are checked first, the detector
+// is invoked again only when it asked for more and they arrived. Waiting is bounded by the read deadline, and by
+// the buffer size of r, when the detector needs more than fits into the buffer bufio.ErrBufferFull is returned and
+// the dispatcher retries with a larger buffer, or treats the conn as not matching.
+func (self DataDetector) Detect(r *bufio.Reader) (bool, error) {
+	n := r.Buffered()
+	if n == 0 {
+		n = 1
+	}
+
+	for {
+		data, err := r.Peek(n)
+		res, need := self(data)
+		switch res {
+		case Match:
+			return true, nil
+		case NoMatch:
+			return false, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if need < 1 {
+			need = 1
+		}
+		if n = len(data) + need; n > r.Size() {
+			return false, bufio.ErrBufferFull
+		}
+		if buffered := r.Buffered(); buffered > n {
+			n = buffered
+		}
+	}
+}
+
+// register a proto with a DataDetector, same as AddProto(name, fn.Detect, opts...), but the dispatcher evaluates the
+// bytes of every read against all DataDetector protos which are still undecided, so a detector isn't re-run on bytes
+// it already needed more than, and the later ones have decided by the time they are reached.
+func (self *Dispatcher) AddDataProto(name string, fn DataDetector, opts ...Option) {
+	self.addProto(&proto{name: name, detectfn: fn.Detect, datafn: fn}, opts)
+}
+
+// WithSnapshot makes detection start with a buffer for up to n bytes instead of the small one, so the protos
+// registered with AddDataProto are evaluated against as many bytes as arrived with the first read. Only applies when
+// passed to New.
+func WithSnapshot(n int) Option {
+	return func(o *options) {
+		o.snapshot = n
+	}
+}
+
+// dataResults holds the decisions of the DataDetector protos during the detection of a conn, indexed like the
+// evaluated protos.
+type dataResults struct {
+	res []Result
+	// the bytes each undecided detector asked for, and the length of the data it last decided on
+	need []int
+	seen []int
+}
+
+func newDataResults(n int) *dataResults {
+	results := &dataResults{res: make([]Result, n), need: make([]int, n), seen: make([]int, n)}
+	for i := range results.res {
+		results.res[i] = NeedMore
+	}
+	return results
+}
+
+// run the DataDetector of protos[i] like DataDetector.Detect does. The bytes of every peek are also passed to the
+// undecided DataDetectors of the later protos which asked for no more than have arrived, so each detector runs once
+// per decision it asked for, regardless of which proto is waiting for more bytes.
+func runData(protos []*proto, i int, bufconn *bufConn, results *dataResults) (bool, error) {
+	n := bufconn.r.Buffered()
+	if n == 0 {
+		n = 1
+	}
+
+	for {
+		data, err := bufconn.r.Peek(n)
+		for k := i; k < len(protos); k++ {
+			if protos[k].datafn == nil || results.res[k] != NeedMore || len(data) < results.seen[k]+results.need[k] {
+				continue
+			}
+
+			res, need := protos[k].datafn(data)
+			if need < 1 {
+				need = 1
+			}
+			results.res[k], results.need[k], results.seen[k] = res, need, len(data)
+		}
+
+		switch results.res[i] {
+		case Match:
+			return true, nil
+		case NoMatch:
+			return false, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		// the bytes don't fit, even after growing the buffer
+		if n = results.seen[i] + results.need[i]; n > bufconn.r.Size() && (!bufconn.grow() || n > bufconn.r.Size()) {
+			return false, nil
+		}
+		if buffered := bufconn.r.Buffered(); buffered > n {
+			n = buffered
+		}
+	}
+}
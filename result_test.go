@@ -0,0 +1,200 @@
+package munproto_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// record the length of the data of every call of a DataDetector
+type callLog struct {
+	mu    sync.Mutex
+	calls map[string][]int
+}
+
+func (self *callLog) wrap(name string, fn munproto.DataDetector) munproto.DataDetector {
+	return func(data []byte) (munproto.Result, int) {
+		self.mu.Lock()
+		self.calls[name] = append(self.calls[name], len(data))
+		self.mu.Unlock()
+		return fn(data)
+	}
+}
+
+func (self *callLog) get(name string) []int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([]int{}, self.calls[name]...)
+}
+
+// match data starting with prefix, asking for its missing bytes
+func prefixData(prefix string) munproto.DataDetector {
+	return func(data []byte) (munproto.Result, int) {
+		if len(data) < len(prefix) {
+			if !strings.HasPrefix(prefix, string(data)) {
+				return munproto.NoMatch, 0
+			}
+			return munproto.NeedMore, len(prefix) - len(data)
+		}
+		if string(data[:len(prefix)]) == prefix {
+			return munproto.Match, 0
+		}
+		return munproto.NoMatch, 0
+	}
+}
+
+func TestDataProtosRerunUndecided(t *testing.T) {
+	log := &callLog{calls: map[string][]int{}}
+
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddDataProto("slow", log.wrap("slow", prefixData("abcdefgh")))
+	d.AddDataProto("never", log.wrap("never", prefixData("xyz")))
+	d.AddDataProto("fast", log.wrap("fast", prefixData("ab")))
+	d.Listener("slow")
+	d.Listener("never")
+	fast := d.Listener("fast")
+	go d.Listen()
+	defer d.Close()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		conn.Write([]byte("a"))
+		time.Sleep(20 * time.Millisecond)
+		conn.Write([]byte("bcdefgX"))
+	}()
+	acceptWithin(t, fast, time.Second).Close()
+
+	// the later protos are evaluated on the bytes "slow" waits for, and aren't run again once it is their turn
+	want := map[string][]int{"slow": {1, 8}, "never": {1}, "fast": {1, 8}}
+	for name, lens := range want {
+		if got := log.get(name); fmt.Sprint(got) != fmt.Sprint(lens) {
+			t.Errorf("%s called with %v bytes, want %v", name, got, lens)
+		}
+	}
+}
+
+func TestDataProtoTooLarge(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddDataProto("huge", func(data []byte) (munproto.Result, int) {
+		return munproto.NeedMore, 1 << 20
+	})
+	d.AddProto("http", munproto.IsHTTP)
+	d.Listener("huge")
+	http := d.Listener("http")
+	go d.Listen()
+	defer d.Close()
+
+	// a detector asking for more than the grown buffer holds doesn't match
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	acceptWithin(t, http, time.Second).Close()
+}
+
+func TestDataDetectorDetect(t *testing.T) {
+	runDetectTests(t, prefixData("abcd").Detect, []detectTest{
+		{"match", "abcdef", true, nil},
+		{"mismatch", "abx", false, nil},
+		{"truncated", "abc", false, io.EOF},
+		{"empty", "", false, io.EOF},
+	})
+}
+
+// memConn is a net.Conn reading data in chunks of chunk bytes, writes are discarded.
+type memConn struct {
+	data  []byte
+	chunk int
+}
+
+func (self *memConn) Read(b []byte) (int, error) {
+	if len(self.data) == 0 {
+		return 0, io.EOF
+	}
+	n := self.chunk
+	if n > len(b) {
+		n = len(b)
+	}
+	if n > len(self.data) {
+		n = len(self.data)
+	}
+	copy(b, self.data[:n])
+	self.data = self.data[n:]
+	return n, nil
+}
+
+func (self *memConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (self *memConn) Close() error                       { return nil }
+func (self *memConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (self *memConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (self *memConn) SetDeadline(t time.Time) error      { return nil }
+func (self *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (self *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// 12 protos matching 16 byte prefixes which differ only in the last byte, the conns match the last one
+func BenchmarkDataProtos(b *testing.B) {
+	const protos = 12
+	prefix := func(i int) string {
+		return fmt.Sprintf("munproto-bench%02d", i)
+	}
+	data := []byte(prefix(protos-1) + " payload")
+
+	tests := []struct {
+		name string
+		opts []munproto.Option
+		data bool
+	}{
+		{"reader", nil, false},
+		{"data", nil, true},
+		{"data snapshot", []munproto.Option{munproto.WithSnapshot(32)}, true},
+	}
+
+	for _, tt := range tests {
+		for _, chunk := range []int{1, 4, len(data)} {
+			b.Run(fmt.Sprintf("%s/chunk=%d", tt.name, chunk), func(b *testing.B) {
+				d := munproto.New(munprototest.NewPipeListener(), time.Second, tt.opts...)
+				var last net.Listener
+				for i := 0; i < protos; i++ {
+					name, fn := prefix(i), prefixData(prefix(i))
+					if tt.data {
+						d.AddDataProto(name, fn)
+					} else {
+						d.AddProto(name, fn.Detect)
+					}
+					last = d.Listener(name)
+				}
+				go func() {
+					for {
+						conn, err := last.Accept()
+						if err != nil {
+							return
+						}
+						conn.Close()
+					}
+				}()
+				defer d.Close()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					d.DispatchConn(&memConn{data: data, chunk: chunk})
+				}
+			})
+		}
+	}
+}
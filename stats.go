@@ -0,0 +1,120 @@
+package munproto
+
+import "sync/atomic"
+
+// Stats is a snapshot of the dispatcher counters.
+type Stats struct {
+	// conns passed to detection
+	Dispatched int64
+	// conns handed to a listener
+	Delivered int64
+	// conns which no proto matched
+	Unmatched int64
+	// conns closed because of a detection error
+	DetectErrors int64
+	// conns closed by the client before sending any bytes
+	Empty int64
+	// recovered panics of detectors
+	Panics int64
+	// clients denied by the policy of the matched proto, including those which fell through to the later protos
+	Denied int64
+	// conns relayed to an upstream address
+	Forwarded int64
+	// failed dials and copy errors of relayed conns
+	ForwardErrors int64
+	// delivered conns closed because of WithIdleTimeout
+	IdleClosed int64
+	// delivered conns closed because of WithMaxConnAge
+	MaxAgeClosed int64
+	// dumps of WithUnmatchedDump dropped by the rate limit or because the writer is slow
+	DumpsDropped int64
+	// conns rejected because of WithHighWater
+	QueueRejected int64
+	// responses written by the responders of SetRejectResponder
+	RejectResponses int64
+	// responses which failed to write, e.g. because the peer is gone
+	RejectFailures int64
+
+	Protos map[string]ProtoStats
+}
+
+// ProtoStats is a snapshot of the counters of a proto.
+type ProtoStats struct {
+	// the outcomes of the detector: conns it matched, including those denied by the policy afterwards, conns it was
+	// evaluated on without matching and failed detections, like timeouts
+	Matched      int64
+	Unmatched    int64
+	DetectErrors int64
+	// throughput of the conns of protos with WithRateLimit, in bytes per second
+	ReadRate  float64
+	WriteRate float64
+	// the counters of the listener of the proto, zero if there is none
+	ListenerStats
+}
+
+// ListenerStats is a snapshot of the counters of a listener.
+type ListenerStats struct {
+	// conns queued for Accept
+	Delivered int64
+	// conns returned by Accept
+	Accepted int64
+	// conns waiting for Accept
+	Pending int64
+	// the maximum of Pending since the listener was created
+	MaxPending int64
+}
+
+// StatsProvider is implemented by the listeners of Dispatcher and TLSListener.
+type StatsProvider interface {
+	Stats() ListenerStats
+}
+
+// return a snapshot of the counters of the listener.
+func (self *listener) Stats() ListenerStats {
+	return ListenerStats{
+		Delivered:  atomic.LoadInt64(&self.delivered),
+		Accepted:   atomic.LoadInt64(&self.accepted),
+		Pending:    atomic.LoadInt64(&self.pending),
+		MaxPending: atomic.LoadInt64(&self.maxPending),
+	}
+}
+
+// return a snapshot of the counters.
+func (self *Dispatcher) Stats() Stats {
+	c := self.counters
+	stats := Stats{
+		Dispatched:      atomic.LoadInt64(&c.Dispatched),
+		Delivered:       atomic.LoadInt64(&c.Delivered),
+		Unmatched:       atomic.LoadInt64(&c.Unmatched),
+		DetectErrors:    atomic.LoadInt64(&c.DetectErrors),
+		Empty:           atomic.LoadInt64(&c.Empty),
+		Panics:          atomic.LoadInt64(&c.Panics),
+		Denied:          atomic.LoadInt64(&c.Denied),
+		Forwarded:       atomic.LoadInt64(&c.Forwarded),
+		ForwardErrors:   atomic.LoadInt64(&c.ForwardErrors),
+		IdleClosed:      atomic.LoadInt64(&c.IdleClosed),
+		MaxAgeClosed:    atomic.LoadInt64(&c.MaxAgeClosed),
+		DumpsDropped:    atomic.LoadInt64(&c.DumpsDropped),
+		QueueRejected:   atomic.LoadInt64(&c.QueueRejected),
+		RejectResponses: atomic.LoadInt64(&c.RejectResponses),
+		RejectFailures:  atomic.LoadInt64(&c.RejectFailures),
+		Protos:          make(map[string]ProtoStats),
+	}
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for name, p := range self.protos {
+		ps := ProtoStats{
+			Matched:      atomic.LoadInt64(&p.counts.matched),
+			Unmatched:    atomic.LoadInt64(&p.counts.unmatched),
+			DetectErrors: atomic.LoadInt64(&p.counts.errors),
+			ReadRate:     p.readLimit.rateNow(),
+			WriteRate:    p.writeLimit.rateNow(),
+		}
+		if ls := self.listeners[name]; ls != nil {
+			ps.ListenerStats = ls.Stats()
+		}
+		stats.Protos[name] = ps
+	}
+	return stats
+}
@@ -0,0 +1,63 @@
+package munproto_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// wait until the listener stats satisfy cond, fails the test after a second
+func waitListenerStats(t *testing.T, sp munproto.StatsProvider, cond func(munproto.ListenerStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond(sp.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected listener stats %+v", sp.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestListenerStatsBursts(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	l := d.Listener("http")
+	sp := l.(munproto.StatsProvider)
+	go d.Listen()
+	defer d.Close()
+
+	burst := func(n int) {
+		for i := 0; i < n; i++ {
+			conn, err := pl.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		}
+	}
+	// a slow consumer
+	accept := func(n int) {
+		for i := 0; i < n; i++ {
+			time.Sleep(5 * time.Millisecond)
+			acceptWithin(t, l, time.Second).Close()
+		}
+	}
+
+	burst(10)
+	waitListenerStats(t, sp, func(s munproto.ListenerStats) bool { return s.Pending == 10 })
+	accept(4)
+	burst(3)
+	// the second burst doesn't reach the high-water mark of the first one
+	want := munproto.ListenerStats{Delivered: 13, Accepted: 4, Pending: 9, MaxPending: 10}
+	waitListenerStats(t, sp, func(s munproto.ListenerStats) bool { return s == want })
+
+	accept(9)
+	want = munproto.ListenerStats{Delivered: 13, Accepted: 13, Pending: 0, MaxPending: 10}
+	waitListenerStats(t, sp, func(s munproto.ListenerStats) bool { return s == want })
+	if got := d.Stats().Protos["http"].ListenerStats; got != want {
+		t.Fatalf("Dispatcher.Stats() of http = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,230 @@
+package munproto
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TLSHandshakeError is reported to Dispatcher.ErrorHandler when the TLS handshake of a conn fails.
+type TLSHandshakeError struct {
+	ConnID     uint64
+	RemoteAddr net.Addr
+	Err        error
+}
+
+func (self *TLSHandshakeError) Error() string {
+	return fmt.Sprintf("tls handshake error from %v: %v", self.RemoteAddr, self.Err)
+}
+
+func (self *TLSHandshakeError) Unwrap() error {
+	return self.Err
+}
+
+// restrict proto to conns which are TLS already, e.g. the conns of a TLSListener dispatched to an inner dispatcher
+// with DispatchConn. For other conns its detector is skipped, so plaintext conns fall through to the next protos and
+// the reject responder of UnmatchedProto.
+func (self *Dispatcher) RequireTLS(proto string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	p, ok := self.protos[proto]
+	if !ok {
+		return fmt.Errorf("munproto: undefined proto: %s", proto)
+	}
+
+	// running dispatches may use the proto, so it is replaced instead of modified
+	required := *p
+	required.requireTLS = true
+	self.protos[proto] = &required
+	self.rebuildSet()
+	return nil
+}
+
+// report whether conn is a TLS conn, like *tls.Conn.
+func isTLSConn(conn net.Conn) bool {
+	_, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	return ok
+}
+
+type certRoute struct {
+	match func(tls.ConnectionState) bool
+	l     *listener
+}
+
+// TLSListener terminates TLS on the conns matched to a proto and routes the handshaked conns to inner listeners.
+// Routes created by CertListener are evaluated first, then the negotiated ALPN protocol decides.
+type TLSListener struct {
+	d *Dispatcher
+	l net.Listener
+
+	mu               sync.Mutex
+	handshakeTimeout time.Duration
+	config           *tls.Config
+	certs            []certRoute
+	alpn             map[string]*listener
+	def              *listener
+	all              []*listener
+	err              error
+}
+
+// create TLSListener which terminates TLS with config on the conns of proto. Conns are delivered to the listeners
+// returned by ALPNListener and Listener.
+func (self *Dispatcher) TLSListener(proto string, config *tls.Config) *TLSListener {
+	tl := &TLSListener{
+		d:                self,
+		l:                self.Listener(proto),
+		handshakeTimeout: self.timeout,
+		config:           config.Clone(),
+		alpn:             make(map[string]*listener),
+	}
+
+	go tl.serve()
+	return tl
+}
+
+// limit the time of the TLS handshake, it defaults to the dispatcher timeout. Zero means no timeout. Applies to the
+// handshakes started afterwards.
+func (self *TLSListener) SetHandshakeTimeout(d time.Duration) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.handshakeTimeout = d
+}
+
+// create listener for conns which negotiated ALPN protocol proto, proto is added to the NextProtos of the config.
+func (self *TLSListener) ALPNListener(proto string) net.Listener {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if l, ok := self.alpn[proto]; ok {
+		return l
+	}
+
+	l := self.newListener(proto)
+	self.alpn[proto] = l
+
+	config := self.config.Clone()
+	config.NextProtos = append(config.NextProtos, proto)
+	self.config = config
+	return l
+}
+
+// create listener for conns presenting a client certificate for which match returns true, match should check
+// cs.VerifiedChains unless the config makes tls verify client certificates. Matchers are evaluated in the order of
+// creation, conns without client certificate (possible with tls.RequestClientCert and the like) are never matched
+// and are routed by ALPN.
+func (self *TLSListener) CertListener(match func(cs tls.ConnectionState) bool) net.Listener {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	l := self.newListener("")
+	self.certs = append(self.certs, certRoute{match, l})
+	return l
+}
+
+// create listener for conns without negotiated ALPN protocol, or with a protocol which has no ALPNListener. If it
+// isn't created, such conns are closed.
+func (self *TLSListener) Listener() net.Listener {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.def == nil {
+		self.def = self.newListener("")
+	}
+	return self.def
+}
+
+func (self *TLSListener) Addr() net.Addr {
+	return self.l.Addr()
+}
+
+func (self *TLSListener) Close() error {
+	return self.l.Close()
+}
+
+// must be called with mu held
+func (self *TLSListener) newListener(proto string) *listener {
+	l := newListener(self.d, proto)
+	self.all = append(self.all, l)
+	if self.err != nil {
+		l.close(self.err)
+	}
+	return l
+}
+
+func (self *TLSListener) serve() {
+	for {
+		conn, err := self.l.Accept()
+		if err != nil {
+			self.mu.Lock()
+			self.err = err
+			for _, l := range self.all {
+				l.close(err)
+			}
+			self.mu.Unlock()
+			return
+		}
+
+		go self.handshake(conn)
+	}
+}
+
+func (self *TLSListener) handshake(conn net.Conn) {
+	self.mu.Lock()
+	config, timeout := self.config, self.handshakeTimeout
+	self.mu.Unlock()
+
+	tlsconn := tls.Server(conn, config)
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsconn.Handshake(); err != nil {
+		self.d.handleError(LogTLSErrors, &TLSHandshakeError{ConnID: ConnID(conn), RemoteAddr: conn.RemoteAddr(), Err: err})
+		conn.Close()
+		return
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	self.route(tlsconn)
+}
+
+func (self *TLSListener) route(conn *tls.Conn) {
+	state := conn.ConnectionState()
+	proto := state.NegotiatedProtocol
+
+	self.mu.Lock()
+	certs := self.certs
+	l, ok := self.alpn[proto]
+	if !ok {
+		l = self.def
+	}
+	self.mu.Unlock()
+
+	if len(state.PeerCertificates) > 0 {
+		for _, route := range certs {
+			if route.match(state) {
+				l = route.l
+				break
+			}
+		}
+	}
+
+	if l == nil {
+		self.d.handleError(LogTLSErrors, fmt.Errorf("no listener for negotiated protocol %q from %v", proto, conn.RemoteAddr()))
+		conn.Close()
+		return
+	}
+
+	l.queued(atomic.AddInt64(&l.pending, 1))
+	select {
+	case l.connCh <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+	l.dequeue()
+}
@@ -0,0 +1,406 @@
+package munproto_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+// testCA issues the server and client certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "munproto test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue a certificate for a server name if ou is empty, otherwise a client certificate with the organizational unit
+func (self *testCA) issue(t *testing.T, name, ou string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{name},
+	}
+	if ou != "" {
+		tmpl.Subject.OrganizationalUnit = []string{ou}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		tmpl.DNSNames = nil
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, self.cert, &key.PublicKey, self.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// create dispatcher terminating TLS on the conns of "https", errors passed to ErrorHandler are sent to the channel
+func tlsDispatcher(t *testing.T, config *tls.Config) (*munproto.Dispatcher, *munprototest.PipeListener, *munproto.TLSListener, chan error) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddProto("https", munproto.IsHTTPS)
+	errs := make(chan error, 16)
+	d.ErrorHandler = func(err error) {
+		errs <- err
+	}
+	tl := d.TLSListener("https", config)
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, pl, tl, errs
+}
+
+// dial pl and run the client side of the handshake in the background, the conn is closed with the test
+func dialTLS(t *testing.T, pl *munprototest.PipeListener, config *tls.Config) *tls.Conn {
+	t.Helper()
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := tls.Client(conn, config)
+	t.Cleanup(func() { client.Close() })
+	go client.Handshake()
+	return client
+}
+
+// close the server side conn of client without waiting for the client to read the close_notify alert
+func closeServer(client *tls.Conn, conn net.Conn) {
+	client.NetConn().Close()
+	conn.Close()
+}
+
+func TestTLSListenerALPN(t *testing.T) {
+	ca := newTestCA(t)
+	_, pl, tl, _ := tlsDispatcher(t, &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "")}})
+	h2 := tl.ALPNListener("h2")
+	h1 := tl.ALPNListener("http/1.1")
+	def := tl.Listener()
+
+	tests := []struct {
+		name   string
+		protos []string
+		l      net.Listener
+	}{
+		{"h2", []string{"h2", "http/1.1"}, h2},
+		{"http/1.1", []string{"http/1.1"}, h1},
+		{"no alpn", nil, def},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialTLS(t, pl, &tls.Config{RootCAs: ca.pool, ServerName: "example.com", NextProtos: tt.protos})
+			conn := acceptWithin(t, tt.l, 2*time.Second)
+			defer closeServer(client, conn)
+
+			go client.Write([]byte("ping"))
+			data := make([]byte, 4)
+			if _, err := io.ReadFull(conn, data); err != nil || string(data) != "ping" {
+				t.Fatalf("read %q, %v over TLS, want ping", data, err)
+			}
+			if state := conn.(*tls.Conn).ConnectionState(); len(tt.protos) > 0 && state.NegotiatedProtocol != tt.protos[0] {
+				t.Fatalf("negotiated %q, want %q", state.NegotiatedProtocol, tt.protos[0])
+			}
+		})
+	}
+}
+
+func TestTLSListenerHandshakeError(t *testing.T) {
+	ca := newTestCA(t)
+	_, pl, tl, errs := tlsDispatcher(t, &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "")}})
+	tl.Listener()
+
+	// the client doesn't trust the certificate and aborts the handshake
+	dialTLS(t, pl, &tls.Config{ServerName: "example.com"})
+
+	var herr *munproto.TLSHandshakeError
+	if err := nextError(t, errs); !errors.As(err, &herr) {
+		t.Fatalf("error = %v, want *TLSHandshakeError", err)
+	}
+}
+
+func TestTLSListenerHandshakeTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	_, pl, tl, errs := tlsDispatcher(t, &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "")}})
+	tl.SetHandshakeTimeout(50 * time.Millisecond)
+	tl.Listener()
+
+	// the start of a ClientHello is enough for IsHTTPS, the handshake waits for the rest
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("\x16\x03\x01\x00\xa5\x01"))
+
+	start := time.Now()
+	var herr *munproto.TLSHandshakeError
+	if err := nextError(t, errs); !errors.As(err, &herr) {
+		t.Fatalf("error = %v, want *TLSHandshakeError", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handshake failed after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestTLSListenerNoListener(t *testing.T) {
+	ca := newTestCA(t)
+	_, pl, tl, errs := tlsDispatcher(t, &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "")}})
+	tl.ALPNListener("h2")
+
+	// no ALPN and no default listener, the conn is reported and closed
+	client := dialTLS(t, pl, &tls.Config{RootCAs: ca.pool, ServerName: "example.com"})
+	if err := nextError(t, errs); !strings.Contains(err.Error(), "no listener for negotiated protocol") {
+		t.Fatalf("error = %v, want no listener", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a conn without listener succeeded")
+	}
+}
+
+func TestTLSListenerCert(t *testing.T) {
+	ca := newTestCA(t)
+	_, pl, tl, _ := tlsDispatcher(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "example.com", "")},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.pool,
+	})
+	admin := tl.CertListener(func(cs tls.ConnectionState) bool {
+		ous := cs.VerifiedChains[0][0].Subject.OrganizationalUnit
+		return len(ous) > 0 && ous[0] == "admin"
+	})
+	def := tl.Listener()
+
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		l     net.Listener
+	}{
+		{"admin", []tls.Certificate{ca.issue(t, "alice", "admin")}, admin},
+		{"other unit", []tls.Certificate{ca.issue(t, "bob", "public")}, def},
+		{"no certificate", nil, def},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialTLS(t, pl, &tls.Config{RootCAs: ca.pool, ServerName: "example.com", Certificates: tt.certs})
+			closeServer(client, acceptWithin(t, tt.l, 2*time.Second))
+		})
+	}
+}
+
+// create a dispatcher which detects the plaintext of the TLS conns of pl, with a pre-detect deadline
+func innerDispatcher(t *testing.T, config *tls.Config, deadline time.Duration) (*munproto.Dispatcher, *munprototest.PipeListener, net.Listener, chan error) {
+	t.Helper()
+	pl := munprototest.NewPipeListener()
+	// the detection timeout is much longer, only the pre-detect deadline bounds the handshake
+	d := munproto.New(tls.NewListener(pl, config), 10*time.Second, munproto.WithPreDetectDeadline(deadline))
+	d.AddProto("http", munproto.IsHTTP)
+	http := d.Listener("http")
+	errs := make(chan error, 16)
+	d.ErrorHandler = func(err error) {
+		errs <- err
+	}
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+	return d, pl, http, errs
+}
+
+func TestPreDetectDeadlineHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	_, pl, http, _ := innerDispatcher(t, &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "")}}, 100*time.Millisecond)
+
+	client := dialTLS(t, pl, &tls.Config{RootCAs: ca.pool, ServerName: "example.com"})
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	delivered := acceptWithin(t, http, time.Second)
+	defer closeServer(client, delivered)
+
+	// the deadline is cleared once the first byte arrived
+	time.Sleep(150 * time.Millisecond)
+	if line := readRequestLine(t, delivered); line != "GET / HTTP/1.1" {
+		t.Fatalf("read %q, want the request line", line)
+	}
+}
+
+func TestPreDetectDeadlineStalled(t *testing.T) {
+	ca := newTestCA(t)
+	d, pl, _, errs := innerDispatcher(t, &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "")}}, 50*time.Millisecond)
+
+	// the client stops in the middle of the ClientHello
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("\x16\x03\x01\x00\xa5\x01"))
+
+	start := time.Now()
+	err = nextError(t, errs)
+	var herr *munproto.TLSHandshakeError
+	var nerr net.Error
+	if !errors.As(err, &herr) || !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("error = %v, want a *TLSHandshakeError timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stalled handshake failed after %v, want about 50ms", elapsed)
+	}
+	if n := d.Stats().DetectErrors; n != 1 {
+		t.Fatalf("DetectErrors = %d, want 1", n)
+	}
+}
+
+func TestPreDetectDeadlineFirstByte(t *testing.T) {
+	ca := newTestCA(t)
+	_, pl, _, errs := innerDispatcher(t, &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "")}}, 50*time.Millisecond)
+
+	// the handshake completes, but the client never sends a byte
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := tls.Client(conn, &tls.Config{RootCAs: ca.pool, ServerName: "example.com"}).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = nextError(t, errs)
+	var herr *munproto.TLSHandshakeError
+	var nerr net.Error
+	if errors.As(err, &herr) || !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("error = %v, want a timeout which isn't a handshake error", err)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	ca := newTestCA(t)
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "")}}
+	// the same protos on the outer dispatcher, which sees the plaintext conns, and the inner one behind TLS
+	plain := func(l net.Listener) net.Listener { return l }
+	tests := []struct {
+		name   string
+		wrap   func(net.Listener) net.Listener
+		client func(net.Conn) net.Conn
+		want   string
+	}{
+		{"plaintext", plain, func(c net.Conn) net.Conn { return c }, munproto.UnmatchedProto},
+		{
+			"tls",
+			func(l net.Listener) net.Listener { return tls.NewListener(l, config) },
+			func(c net.Conn) net.Conn {
+				return tls.Client(c, &tls.Config{RootCAs: ca.pool, ServerName: "example.com"})
+			},
+			"socks5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := munprototest.NewPipeListener()
+			d := munproto.New(tt.wrap(pl), time.Second)
+			d.AddProto("socks5", munproto.IsSOCKS5)
+			d.AddProto("http", munproto.IsHTTP)
+			closeAccepted(d.Listener("socks5"))
+			if err := d.RequireTLS("socks5"); err != nil {
+				t.Fatal(err)
+			}
+			recs := accessLog(d)
+			go d.Listen()
+			defer d.Close()
+
+			conn, err := pl.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			go tt.client(conn).Write([]byte("\x05\x01\x00"))
+
+			if rec := onlyRecord(t, recs); rec.Proto != tt.want {
+				t.Fatalf("DispatchRecord.Proto = %q, want %q", rec.Proto, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireTLSReplaceProtos(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.New(pl, time.Second)
+	d.AddProto("socks5", munproto.IsSOCKS5)
+	d.Listener("socks5")
+	if err := d.RequireTLS("socks5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RequireTLS("nope"); err == nil {
+		t.Fatal("RequireTLS of an undefined proto succeeded")
+	}
+
+	// the constraint survives a reload of the protos
+	if err := d.ReplaceProtos([]munproto.ProtoSpec{{Name: "socks5", Detect: munproto.IsSOCKS5}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range d.DebugState().Protos {
+		if p.Name == "socks5" && !p.RequireTLS {
+			t.Fatal("RequireTLS lost by ReplaceProtos")
+		}
+	}
+
+	recs := accessLog(d)
+	go d.Listen()
+	defer d.Close()
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("\x05\x01\x00"))
+	if rec := onlyRecord(t, recs); rec.Proto != munproto.UnmatchedProto {
+		t.Fatalf("plaintext socks5 delivered to %q after ReplaceProtos", rec.Proto)
+	}
+}
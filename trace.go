@@ -0,0 +1,83 @@
+package munproto
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// TraceRecord holds the first bytes of a conn matched to a traced proto.
+type TraceRecord struct {
+	Time       time.Time
+	ConnID     uint64
+	RemoteAddr net.Addr
+	Proto      string
+	// the bytes peeked during detection, it is only valid during the callback
+	Data []byte
+}
+
+type TraceOption func(*tracer)
+
+// WithSampling makes Trace record only every n-th conn.
+func WithSampling(n int) TraceOption {
+	return func(t *tracer) {
+		if n > 1 {
+			t.sampling = uint64(n)
+		}
+	}
+}
+
+type tracer struct {
+	// accessed atomically, first for 64 bit alignment
+	count uint64
+
+	maxBytes int
+	fn       func(TraceRecord)
+	sampling uint64
+}
+
+// call fn with up to maxBytes of the bytes peeked during detection for conns matched to proto. Only the bytes the
+// detectors have already peeked are recorded, no additional reads are made. fn is called before the conn is
+// delivered, so it must be fast.
+func (self *Dispatcher) Trace(proto string, maxBytes int, fn func(rec TraceRecord), opts ...TraceOption) error {
+	t := &tracer{maxBytes: maxBytes, fn: fn, sampling: 1}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	p, ok := self.protos[proto]
+	if !ok {
+		return fmt.Errorf("munproto: undefined proto: %s", proto)
+	}
+
+	// running dispatches may use the proto, so it is replaced instead of modified
+	traced := *p
+	traced.tracer = t
+	self.protos[proto] = &traced
+	self.rebuildSet()
+	return nil
+}
+
+func (self *tracer) trace(bufconn *bufConn, proto string) {
+	if self.sampling > 1 && atomic.AddUint64(&self.count, 1)%self.sampling != 0 {
+		return
+	}
+
+	n := bufconn.r.Buffered()
+	if n > self.maxBytes {
+		n = self.maxBytes
+	}
+	data, _ := bufconn.r.Peek(n)
+
+	self.fn(TraceRecord{
+		Time:       time.Now(),
+		ConnID:     bufconn.id,
+		RemoteAddr: bufconn.RemoteAddr(),
+		Proto:      proto,
+		Data:       data,
+	})
+}
@@ -0,0 +1,57 @@
+package munproto_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sintanial/go-munproto"
+	"github.com/sintanial/go-munproto/munprototest"
+)
+
+func TestTraceSampling(t *testing.T) {
+	pl := munprototest.NewPipeListener()
+	d := munproto.NewDefault(pl)
+	l := d.Listener("http")
+
+	var mu sync.Mutex
+	var recs []string
+	err := d.Trace("http", 4, func(rec munproto.TraceRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		recs = append(recs, string(rec.Data))
+	}, munproto.WithSampling(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Listen()
+	defer d.Close()
+
+	for i := 0; i < 4; i++ {
+		conn, err := pl.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		acceptWithin(t, l, time.Second).Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(recs) != 2 {
+		t.Fatalf("traced %d conns, want 2", len(recs))
+	}
+	for _, data := range recs {
+		if data != "GET " {
+			t.Errorf("TraceRecord.Data = %q, want %q", data, "GET ")
+		}
+	}
+}
+
+func TestTraceUndefinedProto(t *testing.T) {
+	d := munproto.NewDefault(munprototest.NewPipeListener())
+	if err := d.Trace("nope", 16, func(munproto.TraceRecord) {}); err == nil {
+		t.Fatal("Trace of an undefined proto didn't fail")
+	}
+}